@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints under the admin path (which is never routed to a source).
+const (
+	ADMIN_HEALTHZ = "/healthz"
+	ADMIN_READYZ  = "/readyz"
+	ADMIN_STATUS  = "/status"
+)
+
+// Readiness is checked at most this often (load balancers poll it a lot and
+// each check writes to every store).
+const READINESS_TTL = 10 * time.Second
+
+// Stores must write (and delete) the probe this quickly to be ready.
+var readinessStoreTimeout = 10 * time.Second
+
+// Sources only need to answer (with anything) this quickly to be reachable.
+var readinessClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Routes as loaded (along with what they were routed by) for the admin
+// endpoints.
+type loadedRoute struct {
+	host   string
+	path   string
+	routes *Routes
+}
+
+type readinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready   bool             `json:"ready"`
+	Checked time.Time        `json:"checked"`
+	Checks  []readinessCheck `json:"checks"`
+}
+
+// Most recent readiness result (shared by concurrent /readyz requests).
+type readinessCache struct {
+	sync.Mutex
+	last *readiness
+}
+
+// Write (and delete) a probe object to check the store is reachable and
+// writable.
+func checkStoreWritable(store CacheStore, key string) error {
+	body := []byte("ok")
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	err := store.Put(key, bytes.NewReader(body), int64(len(body)), header)
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
+
+// Give up on the check after the timeout (a check which hangs is left to
+// finish in the background).
+func checkWithin(timeout time.Duration, check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("No answer within %v", timeout)
+	}
+}
+
+// Any response from the origin (even an error status) means it is reachable.
+func checkSourceReachable(origin *url.URL) error {
+	req, err := http.NewRequest("HEAD", origin.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := readinessClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Checks run concurrently so the slowest (rather then the sum of them all)
+// bounds how long they take.
+func checkReadiness(loaded []loadedRoute, proxyID string) *readiness {
+	checked := time.Now()
+	names := []string{}
+	checks := []func() error{}
+	add := func(name string, check func() error) {
+		names = append(names, name)
+		checks = append(checks, check)
+	}
+
+	if len(loaded) == 0 {
+		add("routes", func() error { return fmt.Errorf("No routes are loaded") })
+	}
+
+	stores := map[string]bool{}
+	sources := map[string]bool{}
+	for _, route := range loaded {
+		config := route.routes.config
+		name := config.Store.Name()
+		if !stores[name] {
+			stores[name] = true
+			store := config.Store
+			key := route.routes.storePrefix() + ".readyz/" + proxyID
+			add("store "+name, func() error {
+				return checkWithin(readinessStoreTimeout, func() error {
+					return checkStoreWritable(store, key)
+				})
+			})
+		}
+
+		if len(config.Sources) == 0 {
+			continue
+		}
+		primary := route.routes.origins.Primary()
+		if sources[primary.URL.String()] {
+			continue
+		}
+		sources[primary.URL.String()] = true
+		add("source "+primary.URL.Redacted(), func() error {
+			return checkSourceReachable(primary.URL)
+		})
+	}
+
+	errs := make([]error, len(checks))
+	wait := sync.WaitGroup{}
+	for i, check := range checks {
+		wait.Add(1)
+		go func(i int, check func() error) {
+			defer wait.Done()
+			errs[i] = check()
+		}(i, check)
+	}
+	wait.Wait()
+
+	result := &readiness{Ready: true, Checked: checked}
+	for i, name := range names {
+		entry := readinessCheck{Name: name, OK: errs[i] == nil}
+		if errs[i] != nil {
+			entry.Error = errs[i].Error()
+			result.Ready = false
+		}
+		result.Checks = append(result.Checks, entry)
+	}
+	return result
+}
+
+// Readiness of the routes (checked again once the last result is stale).
+// Concurrent requests wait on the check in progress which is bounded by the
+// store and source timeouts.
+func (self *readinessCache) Check(loaded []loadedRoute, proxyID string) *readiness {
+	defer self.Unlock()
+	self.Lock()
+
+	if self.last == nil || time.Since(self.last.Checked) > READINESS_TTL {
+		self.last = checkReadiness(loaded, proxyID)
+	}
+	return self.last
+}
+
+type routeStatus struct {
+	Host         string   `json:"host"`
+	Path         string   `json:"path"`
+	Sources      []string `json:"sources"`
+	Parents      []string `json:"parents,omitempty"`
+	Peers        []string `json:"peers,omitempty"`
+	Store        string   `json:"store"`
+	Prefix       string   `json:"prefix"`
+	Tee          bool     `json:"tee"`
+	Private      bool     `json:"private"`
+	StorageClass string   `json:"storageClass"`
+}
+
+type storeStatus struct {
+	Fills   int `json:"fills"`
+	Waiters int `json:"waiters"`
+}
+
+type hostStatus struct {
+	Hostname     string `json:"hostname"`
+	Region       string `json:"region"`
+	InstanceType string `json:"instanceType"`
+	InstanceID   string `json:"instanceId"`
+}
+
+type proxyStatus struct {
+	Version   string                  `json:"version"`
+	ProxyID   string                  `json:"proxyId"`
+	Started   time.Time               `json:"started"`
+	Uptime    string                  `json:"uptime"`
+	Host      hostStatus              `json:"host"`
+	DiskCache string                  `json:"diskCache,omitempty"`
+	Routes    []routeStatus           `json:"routes"`
+	Stores    map[string]*storeStatus `json:"stores"`
+}
+
+// Urls without any credentials in them.
+func redactedURLs(urls []*url.URL) []string {
+	redacted := []string{}
+	for _, u := range urls {
+		redacted = append(redacted, u.Redacted())
+	}
+	return redacted
+}
+
+// Must be called while holding the (read) lock.
+func (self *Proxy) status() *proxyStatus {
+	status := &proxyStatus{
+		Version: version,
+		Started: self.started,
+		Uptime:  time.Since(self.started).String(),
+		Routes:  []routeStatus{},
+		Stores:  map[string]*storeStatus{},
+	}
+	if self.hostDetails != nil {
+		status.Host = hostStatus{
+			Hostname:     self.hostDetails.Hostname,
+			Region:       self.hostDetails.Region,
+			InstanceType: self.hostDetails.InstanceType,
+			InstanceID:   self.hostDetails.InstanceID,
+		}
+	}
+	if self.config != nil {
+		status.ProxyID = self.config.Proxy.ProxyID
+		status.DiskCache = self.config.DiskCacheDir
+	}
+
+	for _, route := range self.routes {
+		config := route.routes.config
+		status.Routes = append(status.Routes, routeStatus{
+			Host:         route.host,
+			Path:         route.path,
+			Sources:      redactedURLs(config.Sources),
+			Parents:      redactedURLs(config.Parents),
+			Peers:        redactedURLs(config.Peers),
+			Store:        config.Store.Name(),
+			Prefix:       config.Prefix,
+			Tee:          config.Tee,
+			Private:      config.Private,
+			StorageClass: config.StorageClass,
+		})
+	}
+
+	// Stores no longer routed to may still have fills in progress...
+	for name, requests := range self.requests {
+		fills, waiters := requests.Counts()
+		status.Stores[name] = &storeStatus{Fills: fills, Waiters: waiters}
+	}
+
+	return status
+}
+
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Printf("Cannot encode admin response %v", err)
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	res.Write(append(body, '\n'))
+}
+
+// Respond to requests under the admin path. Returns false for any other
+// request.
+func (self *Proxy) serveAdmin(res http.ResponseWriter, req *http.Request) bool {
+	self.RLock()
+	adminPath := ""
+	if self.config != nil {
+		adminPath = strings.TrimSuffix(self.config.AdminPath, "/")
+	}
+	self.RUnlock()
+
+	if adminPath == "" || !strings.HasPrefix(req.URL.Path, adminPath+"/") {
+		return false
+	}
+
+	switch req.URL.Path[len(adminPath):] {
+	case ADMIN_HEALTHZ:
+		res.Header().Set("Content-Type", "text/plain")
+		res.Header().Set("Cache-Control", "no-store")
+		res.Write([]byte("ok\n"))
+	case ADMIN_READYZ:
+		self.RLock()
+		loaded := self.routes
+		proxyID := self.config.Proxy.ProxyID
+		self.RUnlock()
+
+		result := self.readiness.Check(loaded, proxyID)
+		status := 200
+		if !result.Ready {
+			status = 503
+		}
+		writeJSON(res, status, result)
+	case ADMIN_STATUS:
+		self.RLock()
+		status := self.status()
+		self.RUnlock()
+		writeJSON(res, 200, status)
+	default:
+		http.NotFound(res, req)
+	}
+	return true
+}
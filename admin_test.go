@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Proxy with the default route of the test proxy and the admin endpoints
+// under /_proxy.
+func newTestAdminProxy(t *testing.T, routes *testProxy) *Proxy {
+	proxy := NewProxy(&Metrics{}, &HostDetails{Hostname: "test-host", Region: "faux-region-1"})
+	err := proxy.Load(&Config{Proxy: *routes.config, AdminPath: "/_proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func adminGet(proxy *Proxy, path string, value interface{}) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	res := httptest.NewRecorder()
+	proxy.ServeHTTP(res, req)
+	if value != nil {
+		json.Unmarshal(res.Body.Bytes(), value)
+	}
+	return res
+}
+
+func TestAdminHealthz(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+	proxy := newTestAdminProxy(t, routes)
+
+	res := adminGet(proxy, "/_proxy/healthz", nil)
+	if res.Code != 200 {
+		t.Fatalf("Expected healthz to be 200 got %d", res.Code)
+	}
+
+	res = adminGet(proxy, "/_proxy/nope", nil)
+	if res.Code != 404 {
+		t.Fatalf("Expected unknown admin endpoints to be 404 got %d", res.Code)
+	}
+
+	// The admin path is never routed to the source...
+	if count := routes.sourceCount("/_proxy/nope"); count != 0 {
+		t.Fatalf("Expected no source requests for the admin path got %d", count)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	err := proxy.Load(&Config{Proxy: *routes.config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := adminGet(proxy, "/_proxy/healthz", nil)
+	if res.Code != 302 || routes.sourceCount("/_proxy/healthz") != 1 {
+		t.Fatalf("Expected the request to be proxied got %d %s", res.Code, res.Body.String())
+	}
+}
+
+func TestAdminReadyz(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+	proxy := newTestAdminProxy(t, routes)
+
+	result := readiness{}
+	res := adminGet(proxy, "/_proxy/readyz", &result)
+	if res.Code != 200 || !result.Ready {
+		t.Fatalf("Expected to be ready got %d %s", res.Code, res.Body.String())
+	}
+	if len(result.Checks) != 2 {
+		t.Fatalf("Expected a store and source check got %v", result.Checks)
+	}
+
+	// The probe object is cleaned up...
+	object, err := routes.config.Store.Stat("production/.readyz/test-proxy")
+	if err != nil || object != nil {
+		t.Fatalf("Expected the readiness probe to be deleted got %v %v", object, err)
+	}
+}
+
+func TestAdminReadyzSourceDown(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+	routes.source.Close()
+	proxy := newTestAdminProxy(t, routes)
+
+	result := readiness{}
+	res := adminGet(proxy, "/_proxy/readyz", &result)
+	if res.Code != 503 || result.Ready {
+		t.Fatalf("Expected not to be ready got %d %s", res.Code, res.Body.String())
+	}
+	for _, check := range result.Checks {
+		if check.Name == "store bucket" && !check.OK {
+			t.Fatalf("Expected the store to be ready got %v", check)
+		}
+		if check.Name != "store bucket" && (check.OK || check.Error == "") {
+			t.Fatalf("Expected the source check to fail got %v", check)
+		}
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	sourceURL, _ := url.Parse(routes.source.URL)
+	sourceURL.User = url.UserPassword("user", "secret")
+	routes.config.Sources = []*url.URL{sourceURL}
+	proxy := newTestAdminProxy(t, routes)
+
+	// A fill in progress with a request waiting on it...
+	requests := proxy.requests["bucket"]
+	done, _ := requests.Create("production/pending")
+	requests.AddWaiter()
+	defer requests.Complete("production/pending", done)
+	defer requests.RemoveWaiter()
+
+	status := proxyStatus{}
+	res := adminGet(proxy, "/_proxy/status", &status)
+	if res.Code != 200 {
+		t.Fatalf("Expected status to be 200 got %d", res.Code)
+	}
+
+	if status.Version != version || status.ProxyID != "test-proxy" {
+		t.Fatalf("Unexpected version or id %s %s", status.Version, status.ProxyID)
+	}
+	if status.Host.Hostname != "test-host" || status.Host.Region != "faux-region-1" {
+		t.Fatalf("Unexpected host details %v", status.Host)
+	}
+	if status.Uptime == "" || status.Started.IsZero() {
+		t.Fatalf("Expected the uptime got %s %v", status.Uptime, status.Started)
+	}
+
+	if len(status.Routes) != 1 {
+		t.Fatalf("Expected the default route got %v", status.Routes)
+	}
+	route := status.Routes[0]
+	if route.Path != "/" || route.Store != "bucket" || route.Prefix != "production" {
+		t.Fatalf("Unexpected route %v", route)
+	}
+	if route.Sources[0] != sourceURL.Redacted() {
+		t.Fatalf("Expected the source password to be redacted got %s", route.Sources[0])
+	}
+
+	store := status.Stores["bucket"]
+	if store == nil || store.Fills != 1 || store.Waiters != 1 {
+		t.Fatalf("Expected one fill and waiter got %v", store)
+	}
+}
+
+// Store whose writes hang until released.
+type hungStore struct {
+	CacheStore
+	release chan bool
+}
+
+func (self *hungStore) Put(key string, body io.Reader, contentLength int64, header http.Header) error {
+	<-self.release
+	return self.CacheStore.Put(key, body, contentLength, header)
+}
+
+func TestAdminReadyzStoreHangs(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	defaultTimeout := readinessStoreTimeout
+	readinessStoreTimeout = 50 * time.Millisecond
+	defer func() { readinessStoreTimeout = defaultTimeout }()
+
+	store := &hungStore{CacheStore: routes.config.Store, release: make(chan bool)}
+	defer close(store.release)
+	config := *routes.config
+	config.Store = store
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	err := proxy.Load(&Config{Proxy: config, AdminPath: "/_proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	result := readiness{}
+	go func() {
+		done <- adminGet(proxy, "/_proxy/readyz", &result)
+	}()
+
+	select {
+	case res := <-done:
+		if res.Code != 503 || result.Ready {
+			t.Fatalf("Expected not to be ready got %d %s", res.Code, res.Body.String())
+		}
+		if result.Checks[0].OK || result.Checks[1].Error != "" {
+			t.Fatalf("Expected only the store check to fail got %v", result.Checks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the readiness check not to wait on the store")
+	}
+}
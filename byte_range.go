@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parse a single range "Range" header (bytes=a-b, bytes=a- or bytes=-n) for an
+// object of the given size. Multiple ranges, unknown sizes and unsatisfiable
+// ranges are reported as not ok.
+func parseByteRange(header string, size int64) (start int64, length int64, ok bool) {
+	if size < 0 || !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+
+	spec := strings.TrimSpace(header[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+
+	// Suffix range (the last n bytes)...
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, size > 0
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, true
+}
+
+// Writes only the bytes in [start, start+length) of everything written to it
+// through to the underlying writer (the rest is dropped).
+type rangeWriter struct {
+	writer io.Writer
+	start  int64
+	length int64
+	offset int64
+}
+
+func (self *rangeWriter) Write(p []byte) (int, error) {
+	chunkStart := self.offset
+	self.offset += int64(len(p))
+
+	from := self.start - chunkStart
+	if from < 0 {
+		from = 0
+	}
+
+	to := self.start + self.length - chunkStart
+	if to > int64(len(p)) {
+		to = int64(len(p))
+	}
+
+	if from < to {
+		_, err := self.writer.Write(p[from:to])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
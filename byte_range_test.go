@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	cases := []struct {
+		header string
+		start  int64
+		length int64
+		ok     bool
+	}{
+		{"bytes=0-9", 0, 10, true},
+		{"bytes=5-", 5, 95, true},
+		{"bytes=-10", 90, 10, true},
+		{"bytes=90-200", 90, 10, true},
+		{"bytes=100-", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"bytes=9-1", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		start, length, ok := parseByteRange(c.header, 100)
+		if ok != c.ok || (ok && (start != c.start || length != c.length)) {
+			t.Errorf("%s: got (%d, %d, %v)", c.header, start, length, ok)
+		}
+	}
+
+	if _, _, ok := parseByteRange("bytes=0-1", -1); ok {
+		t.Error("Ranges of unknown sizes should not be satisfiable")
+	}
+}
+
+func TestRangeWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	writer := &rangeWriter{writer: out, start: 3, length: 4}
+
+	for _, chunk := range []string{"xf", "oob", "arba", "z"} {
+		n, err := writer.Write([]byte(chunk))
+		if err != nil || n != len(chunk) {
+			t.Fatalf("Unexpected write result %d %v", n, err)
+		}
+	}
+
+	if out.String() != "obar" {
+		t.Fatalf("Unexpected range content %s", out.String())
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifies this process to other proxies (unless --proxy-id is given).
+var proxyInstanceID = newProxyInstanceID()
+
+func newProxyInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+}
+
+// Options which only make sense on the command line.
+var commandLineOnlyOptions = map[string]bool{
+	"--config":  true,
+	"--help":    true,
+	"--version": true,
+}
+
+// Everything needed to start (or reload) the proxy. Built from the command
+// line arguments and the optional config file.
+type Config struct {
+	Port        int
+	MetadataURL string
+	InfluxDBURL string
+
+	// Default route for requests which do not match the routing table (unused
+	// when it has no sources).
+	Proxy ProxyConfig
+
+	Routes []RouteConfig
+
+	// Local disk cache (disabled when DiskCacheDir is empty).
+	DiskCacheDir    string
+	DiskCacheSize   int64
+	DiskCacheMaxAge time.Duration
+
+	// Longest to wait for requests and fills in progress on SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// Path the health, readiness and status endpoints are served under
+	// (disabled when empty).
+	AdminPath string
+
+	// Credentials of the buckets (and signed sources) of the routes.
+	Auth aws.Auth
+}
+
+// Whether anything configured uses AWS credentials (an s3 store or signed
+// source requests). Local stores and unsigned sources need none.
+func (self *Config) NeedsAWSAuth() bool {
+	if _, ok := self.Proxy.Store.(*S3Store); ok || self.Proxy.SourceRegion != "" {
+		return true
+	}
+	for _, route := range self.Routes {
+		if route.Bucket != "" || route.SourceRegion != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of the options explicitly given on the command line (these win over
+// the config file).
+func explicitOptions(argv []string) map[string]bool {
+	explicit := map[string]bool{}
+	for _, arg := range argv {
+		if strings.HasPrefix(arg, "--") {
+			explicit[strings.SplitN(arg, "=", 2)[0]] = true
+		}
+	}
+	return explicit
+}
+
+// Apply the options in the JSON config file on top of the arguments parsed by
+// docopt. Keys are the long option names without the leading dashes and the
+// "routes" key may hold the routing table itself rather then a file name.
+func applyConfigFile(
+	filename string,
+	arguments map[string]interface{},
+	explicit map[string]bool,
+) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	options := map[string]interface{}{}
+	err = decoder.Decode(&options)
+	if err != nil {
+		return fmt.Errorf("Cannot parse config file %s: %v", filename, err)
+	}
+
+	for name, value := range options {
+		option := "--" + name
+		current, known := arguments[option]
+		if !known || commandLineOnlyOptions[option] {
+			return fmt.Errorf("Unknown option %s in config file %s", name, filename)
+		}
+
+		if explicit[option] {
+			continue
+		}
+
+		switch current.(type) {
+		case bool:
+			flag, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("Option %s must be true or false", name)
+			}
+			arguments[option] = flag
+		case []string:
+			values := []string{}
+			list, ok := value.([]interface{})
+			if !ok {
+				list = []interface{}{value}
+			}
+			for _, item := range list {
+				str, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("Option %s must be a list of strings", name)
+				}
+				values = append(values, str)
+			}
+			arguments[option] = values
+		default:
+			switch typed := value.(type) {
+			case string:
+				arguments[option] = typed
+			case json.Number:
+				arguments[option] = typed.String()
+			case []interface{}:
+				if option != "--routes" {
+					return fmt.Errorf("Option %s must be a string or number", name)
+				}
+				// Round trip the inline routing table into its real type...
+				routes := []RouteConfig{}
+				raw, _ := json.Marshal(typed)
+				err := json.Unmarshal(raw, &routes)
+				if err != nil {
+					return fmt.Errorf("Cannot parse routes in config file %s: %v", filename, err)
+				}
+				arguments[option] = routes
+			default:
+				return fmt.Errorf("Option %s must be a string or number", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func optionalString(arguments map[string]interface{}, name string) string {
+	if arguments[name] == nil {
+		return ""
+	}
+	return arguments[name].(string)
+}
+
+// Convert arguments into their appropriate go types (and validate them).
+func ParseConfig(arguments map[string]interface{}, auth aws.Auth) (*Config, error) {
+	var sources []string
+	if arguments["--source"] != nil {
+		sources = arguments["--source"].([]string)
+	}
+	region := optionalString(arguments, "--region")
+	bucket := optionalString(arguments, "--bucket")
+	s3Endpoint := optionalString(arguments, "--s3-endpoint")
+	s3PathStyle := arguments["--s3-path-style"].(bool)
+
+	port, err := strconv.Atoi(arguments["--port"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse port into int: %v", err)
+	}
+
+	shutdownTimeout, err := time.ParseDuration(arguments["--shutdown-timeout"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse shutdown timeout into duration: %v", err)
+	}
+
+	adminPath := optionalString(arguments, "--admin-path")
+	if adminPath != "" && !strings.HasPrefix(adminPath, "/") {
+		return nil, fmt.Errorf("Admin path must start with / got %s", adminPath)
+	}
+
+	multipartThreshold, err := strconv.ParseInt(arguments["--multipart-threshold"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse multipart threshold into int: %v", err)
+	}
+
+	if multipartThreshold > MAX_SINGLE_PUT_SIZE {
+		return nil, fmt.Errorf("Multipart threshold cannot exceed %d bytes", MAX_SINGLE_PUT_SIZE)
+	}
+
+	multipartPartSize, err := strconv.ParseInt(arguments["--multipart-part-size"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse multipart part size into int: %v", err)
+	}
+
+	if multipartPartSize < MIN_MULTIPART_PART_SIZE {
+		return nil, fmt.Errorf("Multipart part size must be at least %d bytes", MIN_MULTIPART_PART_SIZE)
+	}
+
+	diskCacheSize, err := strconv.ParseInt(arguments["--disk-cache-size"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse disk cache size into int: %v", err)
+	}
+
+	diskCacheMaxAge, err := time.ParseDuration(arguments["--disk-cache-max-age"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse disk cache max age into duration: %v", err)
+	}
+
+	indexSize, err := strconv.Atoi(arguments["--index-size"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse index size into int: %v", err)
+	}
+
+	indexTTL, err := time.ParseDuration(arguments["--index-ttl"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse index ttl into duration: %v", err)
+	}
+
+	indexNegativeTTL, err := time.ParseDuration(arguments["--index-negative-ttl"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse index negative ttl into duration: %v", err)
+	}
+
+	negativeCacheTTL, err := time.ParseDuration(arguments["--negative-cache-ttl"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse negative cache ttl into duration: %v", err)
+	}
+
+	teeMaxClientLag, err := strconv.ParseInt(arguments["--tee-max-client-lag"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse tee max client lag into int: %v", err)
+	}
+
+	if teeMaxClientLag <= 0 {
+		return nil, fmt.Errorf("Tee max client lag must be positive")
+	}
+
+	maxSpoolSize, err := strconv.ParseInt(arguments["--max-spool-size"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse max spool size into int: %v", err)
+	}
+
+	revalidateAfter, err := time.ParseDuration(arguments["--revalidate-after"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse revalidate after into duration: %v", err)
+	}
+
+	maxSourcePullWait, err := time.ParseDuration(arguments["--max-source-pull-wait"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse max source pull wait into duration: %v", err)
+	}
+
+	private := arguments["--private"].(bool)
+	signedURLExpiry, err := time.ParseDuration(arguments["--signed-url-expiry"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse signed url expiry into duration: %v", err)
+	}
+
+	if private && signedURLExpiry <= 0 {
+		return nil, fmt.Errorf("Signed url expiry must be positive")
+	}
+
+	metadata, err := parseMetadata(optionalString(arguments, "--metadata"))
+	if err != nil {
+		return nil, err
+	}
+
+	fillLockLease, err := time.ParseDuration(arguments["--fill-lock-lease"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse fill lock lease into duration: %v", err)
+	}
+
+	fillLockPoll, err := time.ParseDuration(arguments["--fill-lock-poll"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse fill lock poll into duration: %v", err)
+	}
+
+	if fillLockPoll <= 0 {
+		return nil, fmt.Errorf("Fill lock poll must be positive")
+	}
+
+	proxyID := optionalString(arguments, "--proxy-id")
+	if proxyID == "" {
+		proxyID = proxyInstanceID
+	}
+
+	parents := []*url.URL{}
+	for _, parent := range parseList(optionalString(arguments, "--parents")) {
+		parentURL, err := url.Parse(parent)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing parent into url : %v", err)
+		}
+		parents = append(parents, parentURL)
+	}
+
+	peers := []*url.URL{}
+	for _, peer := range parseList(optionalString(arguments, "--peers")) {
+		peerURL, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing peer into url : %v", err)
+		}
+		peers = append(peers, peerURL)
+	}
+
+	var peerSelf *url.URL
+	if self := optionalString(arguments, "--peer-self"); self != "" {
+		peerSelf, err = url.Parse(self)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing peer self into url : %v", err)
+		}
+	}
+
+	if len(peers) > 0 && peerSelf == nil {
+		return nil, fmt.Errorf("Peer self is required with peers")
+	}
+
+	peerVirtualNodes, err := strconv.Atoi(arguments["--peer-virtual-nodes"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse peer virtual nodes into int: %v", err)
+	}
+
+	if peerVirtualNodes <= 0 {
+		return nil, fmt.Errorf("Peer virtual nodes must be positive")
+	}
+
+	expireAfter, err := time.ParseDuration(arguments["--expire-after"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse expire after into duration: %v", err)
+	}
+
+	maxStoreSize, err := strconv.ParseInt(arguments["--max-store-size"].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse max store size into int: %v", err)
+	}
+
+	janitorInterval, err := time.ParseDuration(arguments["--janitor-interval"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse janitor interval into duration: %v", err)
+	}
+
+	if janitorInterval <= 0 {
+		return nil, fmt.Errorf("Janitor interval must be positive")
+	}
+
+	lifecycleDays, err := strconv.Atoi(arguments["--lifecycle-days"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse lifecycle days into int: %v", err)
+	}
+
+	passthrough := defaultPassthroughHeaders
+	if names := optionalString(arguments, "--passthrough-headers"); names != "" {
+		passthrough = parseList(names)
+	}
+
+	sourceURLs := []*url.URL{}
+	for _, source := range sources {
+		sourceURL, err := url.Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing source into url : %v", err)
+		}
+		sourceURLs = append(sourceURLs, sourceURL)
+	}
+
+	// Without a routing table a store must be set, with one it is the default
+	// for routes which do not set their own.
+	var store CacheStore
+	var s3Bucket *s3.Bucket
+	if storeDir := optionalString(arguments, "--store-dir"); storeDir != "" {
+		store, err = NewFileStore(storeDir)
+		if err != nil {
+			return nil, err
+		}
+	} else if region != "" && bucket != "" {
+		awsRegionObj, err := strToRegion(region, s3Endpoint, s3PathStyle)
+		if err != nil {
+			return nil, err
+		}
+
+		client := s3.New(auth, *awsRegionObj)
+		s3Bucket = client.Bucket(bucket)
+	}
+
+	var routes []RouteConfig
+	switch routesOption := arguments["--routes"].(type) {
+	case string:
+		routes, err = LoadRouteConfigs(routesOption)
+		if err != nil {
+			return nil, err
+		}
+	case []RouteConfig:
+		routes = routesOption
+	}
+
+	if len(sourceURLs) == 0 && len(routes) == 0 {
+		return nil, fmt.Errorf("At least one source or route is required")
+	}
+
+	if len(sourceURLs) > 0 && store == nil && s3Bucket == nil {
+		return nil, fmt.Errorf("Region and bucket (or a store dir) are required with a source")
+	}
+
+	config := &Config{
+		Port:        port,
+		MetadataURL: optionalString(arguments, "--metadata-url"),
+		InfluxDBURL: optionalString(arguments, "--influxdb-url"),
+
+		Proxy: ProxyConfig{
+			Sources:      sourceURLs,
+			SourceRegion: optionalString(arguments, "--source-region"),
+			SourceAuth:   auth,
+			Store:        store,
+			Prefix:       optionalString(arguments, "--prefix"),
+
+			S3Endpoint:  s3Endpoint,
+			S3PathStyle: s3PathStyle,
+
+			MultipartThreshold: multipartThreshold,
+			MultipartPartSize:  multipartPartSize,
+
+			Tee:             arguments["--tee"].(bool),
+			TeeMaxClientLag: teeMaxClientLag,
+
+			Private:         private,
+			SignedURLExpiry: signedURLExpiry,
+
+			StorageClass: arguments["--storage-class"].(string),
+			ACL:          optionalString(arguments, "--acl"),
+			SSE:          optionalString(arguments, "--sse"),
+			SSEKMSKeyID:  optionalString(arguments, "--sse-kms-key-id"),
+			Metadata:     metadata,
+
+			PassthroughHeaders: passthrough,
+
+			FillLockLease: fillLockLease,
+			FillLockPoll:  fillLockPoll,
+
+			ProxyID: proxyID,
+			Parents: parents,
+
+			Peers:            peers,
+			PeerSelf:         peerSelf,
+			PeerVirtualNodes: peerVirtualNodes,
+
+			ExpireAfter:     expireAfter,
+			MaxStoreSize:    maxStoreSize,
+			JanitorInterval: janitorInterval,
+			LifecycleDays:   lifecycleDays,
+
+			IndexSize:        indexSize,
+			IndexTTL:         indexTTL,
+			IndexNegativeTTL: indexNegativeTTL,
+
+			NegativeCacheTTL:     negativeCacheTTL,
+			NegativeCacheRespond: arguments["--negative-cache-respond"].(bool),
+
+			MaxSpoolSize:      maxSpoolSize,
+			RevalidateAfter:   revalidateAfter,
+			VerifySHA256:      arguments["--verify-sha256"].(bool),
+			MaxSourcePullWait: maxSourcePullWait,
+		},
+
+		Routes: routes,
+
+		DiskCacheDir:    optionalString(arguments, "--disk-cache-dir"),
+		DiskCacheSize:   diskCacheSize,
+		DiskCacheMaxAge: diskCacheMaxAge,
+
+		ShutdownTimeout: shutdownTimeout,
+		AdminPath:       adminPath,
+
+		Auth: auth,
+	}
+
+	err = validateObjectOptions(&config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The s3 store depends on the storage options above...
+	if s3Bucket != nil {
+		config.Proxy.Store = configuredS3Store(s3Bucket, &config.Proxy)
+	}
+
+	// Check the routes now rather then when they are used...
+	for _, route := range routes {
+		_, err := route.ProxyConfig(&config.Proxy, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/goamz/goamz/aws"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func parseArguments(t *testing.T, argv []string) map[string]interface{} {
+	arguments, err := docopt.Parse(usage, argv, true, version, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arguments
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	filename := writeConfigFile(t, `{
+		"source": ["https://a.example.com", "https://b.example.com"],
+		"region": "us-east-1",
+		"bucket": "from-file",
+		"port": 9000,
+		"tee": true,
+		"routes": [{"path": "/tc", "sources": ["https://tc.example.com"]}]
+	}`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	argv := []string{"--config=" + filename, "--bucket=from-flag"}
+	arguments := parseArguments(t, argv)
+
+	err := applyConfigFile(filename, arguments, explicitOptions(argv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseConfig(arguments, aws.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Proxy.Sources) != 2 || config.Proxy.Sources[1].Host != "b.example.com" {
+		t.Fatalf("Unexpected sources %v", config.Proxy.Sources)
+	}
+	if config.Proxy.Store.Name() != "from-flag" {
+		t.Fatalf("Command line should win over the config file got %s", config.Proxy.Store.Name())
+	}
+	if config.Port != 9000 || !config.Proxy.Tee {
+		t.Fatalf("Options from config file not applied %v", config)
+	}
+	if len(config.Routes) != 1 || config.Routes[0].Path != "/tc" {
+		t.Fatalf("Unexpected routes %v", config.Routes)
+	}
+}
+
+func TestApplyConfigFileRejectsInvalidOptions(t *testing.T) {
+	contents := []string{
+		`{"not-an-option": "foo"}`,
+		`{"tee": "yes"}`,
+		`{"port": true}`,
+		`{"config": "other.json"}`,
+		`{"source": [1]}`,
+		`not json`,
+	}
+
+	for _, content := range contents {
+		filename := writeConfigFile(t, content)
+		defer os.RemoveAll(filepath.Dir(filename))
+
+		argv := []string{"--config=" + filename}
+		err := applyConfigFile(filename, parseArguments(t, argv), explicitOptions(argv))
+		if err == nil {
+			t.Fatalf("Expected error for %s", content)
+		}
+	}
+}
+
+func TestParseConfigRequiresSource(t *testing.T) {
+	filename := writeConfigFile(t, `{"region": "us-east-1", "bucket": "foo"}`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	argv := []string{"--config=" + filename}
+	arguments := parseArguments(t, argv)
+	err := applyConfigFile(filename, arguments, explicitOptions(argv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseConfig(arguments, aws.Auth{})
+	if err == nil {
+		t.Fatal("Expected error without a source or routes")
+	}
+}
+
+func TestParseConfigAdminPath(t *testing.T) {
+	argv := []string{"--source=http://example.com", "--region=us-east-1", "--bucket=foo"}
+	config, err := ParseConfig(parseArguments(t, argv), aws.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AdminPath != "/_proxy" {
+		t.Fatalf("Expected the default admin path got %s", config.AdminPath)
+	}
+
+	_, err = ParseConfig(parseArguments(t, append(argv, "--admin-path=_proxy")), aws.Auth{})
+	if err == nil {
+		t.Fatal("Expected error for an admin path without a leading /")
+	}
+}
+
+func TestParseConfigNeedsAWSAuth(t *testing.T) {
+	config, err := ParseConfig(parseArguments(t, []string{
+		"--source=http://example.com", "--region=us-east-1", "--bucket=foo",
+	}), aws.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.NeedsAWSAuth() {
+		t.Fatal("Expected a bucket to need credentials")
+	}
+
+	// Routes caching into their own bucket need them too...
+	filename := writeConfigFile(t, `{
+		"source": ["http://example.com"],
+		"prefix": "default",
+		"routes": [{"path": "/tc", "sources": ["https://tc.example.com"], "region": "us-east-1", "bucket": "tc"}]
+	}`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	dir, err := ioutil.TempDir("", "config-test-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	argv := []string{"--config=" + filename, "--store-dir=" + dir}
+	arguments := parseArguments(t, argv)
+	err = applyConfigFile(filename, arguments, explicitOptions(argv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ParseConfig(arguments, aws.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.NeedsAWSAuth() {
+		t.Fatal("Expected a route with a bucket to need credentials")
+	}
+
+	config.Routes = nil
+	if config.NeedsAWSAuth() {
+		t.Fatal("Expected a local store to need no credentials")
+	}
+}
+
+func TestParseConfigStoreDirWithoutBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	argv := []string{"--source=http://example.com", "--store-dir=" + dir}
+	config, err := ParseConfig(parseArguments(t, argv), aws.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Proxy.Store.(*FileStore); !ok || config.NeedsAWSAuth() {
+		t.Fatalf("Expected a local store without credentials got %v", config.Proxy.Store)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of files which are still being written (these are removed on startup).
+const DISK_CACHE_TMP_PREFIX = "fill-"
+
+// Sidecar file holding the diskCacheEntry for each cached object.
+const DISK_CACHE_META_SUFFIX = ".json"
+
+type diskCacheEntry struct {
+	Key     string
+	Size    int64
+	Header  http.Header
+	Created time.Time
+}
+
+// Size bound LRU cache of objects on local disk. This is intended to sit in
+// front of the cache bucket so hot objects are served directly from the host.
+// DiskCache is thread safe.
+type DiskCache struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// Total bytes of all committed entries.
+	size int64
+	// Front of the list is the most recently used entry.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// Pending write of an object into the disk cache. Nothing is visible to
+// readers until Commit is called.
+type diskCacheWriter struct {
+	cache   *DiskCache
+	entry   *diskCacheEntry
+	file    *os.File
+	written int64
+	// First error writing to disk (reported by Commit).
+	err error
+}
+
+func NewDiskCache(dir string, maxBytes int64, maxAge time.Duration) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// Change the size and age bounds of the cache (evicting as needed).
+func (self *DiskCache) SetLimits(maxBytes int64, maxAge time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.maxBytes = maxBytes
+	self.maxAge = maxAge
+	self.evict()
+}
+
+// Rebuild the index from the sidecar files of a previous run.
+func (self *DiskCache) load() error {
+	files, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, DISK_CACHE_TMP_PREFIX) {
+			os.Remove(filepath.Join(self.dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, DISK_CACHE_META_SUFFIX) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(self.dir, name))
+		if err != nil {
+			return err
+		}
+
+		entry := &diskCacheEntry{}
+		err = json.Unmarshal(content, entry)
+		if err != nil {
+			log.Printf("Ignoring invalid disk cache entry %s %v", name, err)
+			continue
+		}
+
+		self.insert(entry)
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	self.evict()
+
+	log.Printf("Loaded %d objects (%d bytes) into disk cache", self.lru.Len(), self.size)
+	return nil
+}
+
+func (self *DiskCache) path(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(self.dir, hex.EncodeToString(hash[:]))
+}
+
+// Must be called while holding the lock.
+func (self *DiskCache) remove(element *list.Element) {
+	entry := element.Value.(*diskCacheEntry)
+	self.lru.Remove(element)
+	delete(self.entries, entry.Key)
+	self.size -= entry.Size
+
+	path := self.path(entry.Key)
+	os.Remove(path + DISK_CACHE_META_SUFFIX)
+	os.Remove(path)
+}
+
+// Must be called while holding the lock.
+func (self *DiskCache) evict() {
+	for self.size > self.maxBytes && self.lru.Len() > 0 {
+		self.remove(self.lru.Back())
+	}
+}
+
+func (self *DiskCache) insert(entry *diskCacheEntry) {
+	self.Lock()
+	defer self.Unlock()
+
+	if existing := self.entries[entry.Key]; existing != nil {
+		self.lru.Remove(existing)
+		self.size -= existing.Value.(*diskCacheEntry).Size
+	}
+
+	self.entries[entry.Key] = self.lru.PushFront(entry)
+	self.size += entry.Size
+}
+
+// Open the cached object for the given key. The caller is responsible for
+// closing the file.
+func (self *DiskCache) Get(key string) (*os.File, *diskCacheEntry, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	element := self.entries[key]
+	if element == nil {
+		return nil, nil, false
+	}
+
+	entry := element.Value.(*diskCacheEntry)
+	if self.maxAge > 0 && time.Now().Sub(entry.Created) > self.maxAge {
+		self.remove(element)
+		return nil, nil, false
+	}
+
+	file, err := os.Open(self.path(key))
+	if err != nil {
+		log.Printf("Removing unreadable disk cache entry %s %v", key, err)
+		self.remove(element)
+		return nil, nil, false
+	}
+
+	self.lru.MoveToFront(element)
+	return file, entry, true
+}
+
+// Remove the key from the cache (if present).
+func (self *DiskCache) Remove(key string) {
+	self.Lock()
+	defer self.Unlock()
+
+	if element := self.entries[key]; element != nil {
+		self.remove(element)
+	}
+}
+
+// Serve the given key from disk (if present). Range and conditional requests
+// are handled by `http.ServeContent`.
+func (self *DiskCache) Serve(key string, res http.ResponseWriter, req *http.Request) bool {
+	file, entry, ok := self.Get(key)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+
+	for name, values := range entry.Header {
+		res.Header()[name] = values
+	}
+
+	log.Printf("Disk cache hit %s", key)
+	http.ServeContent(res, req, "", entry.Created, file)
+	return true
+}
+
+// Begin writing an object into the disk cache which is served with the given
+// headers. Returns nil if the object could never fit in the cache.
+func (self *DiskCache) Writer(key string, header http.Header, size int64) (*diskCacheWriter, error) {
+	if size > self.maxBytes {
+		return nil, nil
+	}
+
+	file, err := ioutil.TempFile(self.dir, DISK_CACHE_TMP_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	entryHeader := canonicalHeader(header)
+
+	return &diskCacheWriter{
+		cache: self,
+		file:  file,
+		entry: &diskCacheEntry{
+			Key:    key,
+			Size:   size,
+			Header: entryHeader,
+		},
+	}, nil
+}
+
+// Errors are never returned from Write so a full (or broken) disk does not
+// interrupt the upload to the bucket which is reading the same stream.
+func (self *diskCacheWriter) Write(p []byte) (int, error) {
+	if self.err != nil {
+		return len(p), nil
+	}
+
+	n, err := self.file.Write(p)
+	self.written += int64(n)
+	self.err = err
+	return len(p), nil
+}
+
+// Throw away the pending write.
+func (self *diskCacheWriter) Abort() {
+	self.file.Close()
+	os.Remove(self.file.Name())
+}
+
+// Make the object visible to readers (evicting older entries as needed).
+func (self *diskCacheWriter) Commit() error {
+	if self.err != nil {
+		self.Abort()
+		return self.err
+	}
+
+	if self.written != self.entry.Size {
+		self.Abort()
+		return fmt.Errorf(
+			"Wrote %d of %d bytes for %s", self.written, self.entry.Size, self.entry.Key,
+		)
+	}
+
+	err := self.file.Close()
+	if err != nil {
+		os.Remove(self.file.Name())
+		return err
+	}
+
+	self.entry.Created = time.Now()
+	meta, err := json.Marshal(self.entry)
+	if err != nil {
+		os.Remove(self.file.Name())
+		return err
+	}
+
+	path := self.cache.path(self.entry.Key)
+	err = os.Rename(self.file.Name(), path)
+	if err != nil {
+		os.Remove(self.file.Name())
+		return err
+	}
+
+	err = ioutil.WriteFile(path+DISK_CACHE_META_SUFFIX, meta, 0644)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	self.cache.insert(self.entry)
+
+	self.cache.Lock()
+	defer self.cache.Unlock()
+	self.cache.evict()
+	return nil
+}
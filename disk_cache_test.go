@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeDiskCache(t *testing.T, cache *DiskCache, key string, content string) {
+	writer, err := cache.Writer(key, http.Header{"Content-Type": {"text/plain"}}, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(content))
+	err = writer.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeDiskCache(t, cache, "a", "xfoo")
+	writeDiskCache(t, cache, "b", "xbar")
+
+	// Touch "a" so "b" is the least recently used entry...
+	file, _, ok := cache.Get("a")
+	if !ok {
+		t.Fatal("Expected a to be cached")
+	}
+	file.Close()
+
+	writeDiskCache(t, cache, "c", "xbaz")
+
+	if _, _, ok := cache.Get("b"); ok {
+		t.Fatal("Expected b to be evicted")
+	}
+
+	file, entry, ok := cache.Get("c")
+	if !ok {
+		t.Fatal("Expected c to be cached")
+	}
+	defer file.Close()
+
+	content, _ := ioutil.ReadAll(file)
+	if string(content) != "xbaz" || entry.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Unexpected entry %s %v", content, entry.Header)
+	}
+
+	// A new cache in the same directory picks up the existing entries...
+	reloaded, err := NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := reloaded.Get("a"); !ok {
+		t.Fatal("Expected a to be loaded from disk")
+	}
+}
+
+func TestDiskCacheTruncatedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := cache.Writer("a", http.Header{}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(bytes.Repeat([]byte("x"), 2))
+
+	if writer.Commit() == nil {
+		t.Fatal("Expected commit of truncated object to fail")
+	}
+
+	if _, _, ok := cache.Get("a"); ok {
+		t.Fatal("Truncated object should not be cached")
+	}
+}
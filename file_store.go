@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Layout of the directory of a FileStore.
+const (
+	FILE_STORE_DATA_DIR = "data"
+	FILE_STORE_META_DIR = "meta"
+	FILE_STORE_TMP_DIR  = "tmp"
+)
+
+// Headers served along with objects from a FileStore (along with any
+// x-amz-meta-* metadata, the same as s3 would).
+var fileStoreServeHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Cache-Control",
+	"Expires",
+	"Content-Language",
+}
+
+// CacheStore which keeps objects in a local directory and serves them itself
+// (for running without a regional bucket). Objects are stored under their key
+// in the data directory with their headers in a json file of the same name in
+// the meta directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, subdir := range []string{FILE_STORE_DATA_DIR, FILE_STORE_META_DIR, FILE_STORE_TMP_DIR} {
+		err := os.MkdirAll(filepath.Join(dir, subdir), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+// Paths of the data and metadata of the key.
+func (self *FileStore) paths(key string) (string, string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != key {
+		return "", "", fmt.Errorf("Invalid key %s", key)
+	}
+
+	name := filepath.FromSlash(cleaned)
+	return filepath.Join(self.dir, FILE_STORE_DATA_DIR, name),
+		filepath.Join(self.dir, FILE_STORE_META_DIR, name+".json"),
+		nil
+}
+
+func (self *FileStore) Name() string {
+	return self.dir
+}
+
+func (self *FileStore) Stat(key string) (*CacheObject, error) {
+	dataPath, metaPath, err := self.paths(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dataPath)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	meta, err := ioutil.ReadFile(metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(meta, &header)
+		if err != nil {
+			log.Printf("Ignoring invalid metadata of %s %v", key, err)
+		}
+	}
+
+	return &CacheObject{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Header:       header,
+	}, nil
+}
+
+func (self *FileStore) Put(key string, body io.Reader, contentLength int64, header http.Header) error {
+	dataPath, metaPath, err := self.paths(key)
+	if err != nil {
+		return err
+	}
+
+	// Headers may be in any case (goamz does not care) so normalize them
+	// before they are looked at or stored.
+	header = canonicalHeader(header)
+
+	file, err := ioutil.TempFile(filepath.Join(self.dir, FILE_STORE_TMP_DIR), "put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(file, io.TeeReader(body, hash))
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	// Reject bad bodies the same way s3 would...
+	if written != contentLength {
+		return fmt.Errorf("Expected %d bytes for %s got %d", contentLength, key, written)
+	}
+	contentMD5 := header.Get("Content-MD5")
+	if contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+		return fmt.Errorf("Content-MD5 of %s does not match the body", key)
+	}
+
+	meta, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{filepath.Dir(dataPath), filepath.Dir(metaPath)} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(metaPath, meta, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), dataPath)
+}
+
+func canonicalHeader(header http.Header) http.Header {
+	canonical := http.Header{}
+	for name, values := range header {
+		canonical[http.CanonicalHeaderKey(name)] = values
+	}
+	return canonical
+}
+
+func (self *FileStore) Serve(key string, res http.ResponseWriter, req *http.Request) {
+	object, err := self.Stat(key)
+	if err != nil || object == nil {
+		log.Printf("Cannot serve %s from file store %v", key, err)
+		http.NotFound(res, req)
+		return
+	}
+
+	dataPath, _, _ := self.paths(key)
+	file, err := os.Open(dataPath)
+	if err != nil {
+		log.Printf("Cannot serve %s from file store %v", key, err)
+		http.NotFound(res, req)
+		return
+	}
+	defer file.Close()
+
+	for _, name := range fileStoreServeHeaders {
+		if value := object.Header.Get(name); value != "" {
+			res.Header().Set(name, value)
+		}
+	}
+	for name, values := range object.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			res.Header()[name] = values
+		}
+	}
+
+	log.Printf("Cache hit serving %s from %s", key, self.dir)
+	http.ServeContent(res, req, "", object.LastModified, file)
+}
+
+func (self *FileStore) Delete(key string) error {
+	dataPath, metaPath, err := self.paths(key)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(metaPath)
+	err = os.Remove(dataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (self *FileStore) DeleteMulti(keys []string) error {
+	for _, key := range keys {
+		err := self.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *FileStore) List(prefix string, fn func(object *CacheObject) bool) error {
+	dataDir := filepath.Join(self.dir, FILE_STORE_DATA_DIR)
+	stop := fmt.Errorf("stop")
+
+	err := filepath.Walk(dataDir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(dataDir, filename)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+
+		if info.IsDir() {
+			// Skip directories which cannot contain anything under the prefix.
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		object := &CacheObject{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		}
+		if !fn(object) {
+			return stop
+		}
+		return nil
+	})
+
+	if err == stop {
+		return nil
+	}
+	return err
+}
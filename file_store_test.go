@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newTestFileStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "file-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	testCacheStore(t, store)
+}
+
+func TestFileStoreServe(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	putString(t, store, "hit", "xfoo", http.Header{"Content-Type": {"text/x-foo"}})
+
+	req, _ := http.NewRequest("GET", "http://localhost/hit", nil)
+	req.Header.Set("Range", "bytes=1-")
+	res := httptest.NewRecorder()
+	store.Serve("hit", res, req)
+
+	if res.Code != 206 || res.Body.String() != "foo" {
+		t.Fatalf("Unexpected response %d %s", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Type") != "text/x-foo" {
+		t.Fatalf("Unexpected content type %s", res.Header().Get("Content-Type"))
+	}
+}
+
+func TestFileStoreRejectsBadBodies(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	err := store.Put("short", bytes.NewReader([]byte("xfoo")), 10, http.Header{})
+	if err == nil {
+		t.Fatal("Expected error for truncated body")
+	}
+
+	err = store.Put("corrupt", bytes.NewReader([]byte("xbar")), 4, http.Header{
+		"Content-MD5": {XFOO_CONTENT_MD5},
+	})
+	if err == nil {
+		t.Fatal("Expected error for body not matching Content-MD5")
+	}
+
+	for _, key := range []string{"short", "corrupt"} {
+		object, _ := store.Stat(key)
+		if object != nil {
+			t.Fatalf("Rejected object %s was stored", key)
+		}
+	}
+
+	for _, key := range []string{"../escape", "a//b", ""} {
+		err = store.Put(key, bytes.NewReader([]byte("xfoo")), 4, http.Header{})
+		if err == nil {
+			t.Fatalf("Expected error for invalid key %s", key)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lock objects of an S3Store are kept under this prefix.
+const FILL_LOCK_PREFIX = ".fill-locks/"
+
+// Directory of the lock files of a FileStore.
+const FILE_STORE_LOCK_DIR = "locks"
+
+// Metadata of s3 lock objects.
+const (
+	FILL_LOCK_OWNER_META   = "x-amz-meta-fill-lock-owner"
+	FILL_LOCK_EXPIRES_META = "x-amz-meta-fill-lock-expires"
+)
+
+// Returned when renewing a claim which another owner has taken over.
+var errFillLost = errors.New("Fill lock is held by another owner")
+
+// Stores which can coordinate cache fills between the proxies sharing them.
+// Claims are leases which expire so a proxy which dies mid fill does not
+// block everyone else for good. Losing a race on a claim only means the key
+// is filled twice.
+type FillLocker interface {
+	// Claim the fill of the key for the lease. Returns false (and no error)
+	// when another owner holds an unexpired claim.
+	ClaimFill(key, owner string, lease time.Duration) (bool, error)
+
+	// Extend a claim already held by owner. Returns errFillLost when the
+	// claim has been taken over.
+	RenewFill(key, owner string, lease time.Duration) error
+
+	// Give up the claim (if it is still held by owner).
+	ReleaseFill(key, owner string) error
+
+	// Whether anyone holds an unexpired claim on the key.
+	FillClaimed(key string) (bool, error)
+}
+
+// Content of a lock.
+type fillClaim struct {
+	Owner   string
+	Expires time.Time
+
+	// Of the s3 lock object the claim was read from.
+	etag string
+}
+
+func (self *fillClaim) Expired() bool {
+	return time.Now().After(self.Expires)
+}
+
+func (self *S3Store) lockKey(key string) string {
+	return FILL_LOCK_PREFIX + key
+}
+
+func (self *S3Store) putClaim(key, owner string, lease time.Duration, condition http.Header) error {
+	header := http.Header{
+		"Content-Type":         {"text/plain"},
+		FILL_LOCK_OWNER_META:   {owner},
+		FILL_LOCK_EXPIRES_META: {time.Now().Add(lease).UTC().Format(time.RFC3339Nano)},
+	}
+	for name, values := range condition {
+		header[name] = values
+	}
+	return self.Bucket.PutReaderHeader(self.lockKey(key), bytes.NewReader(nil), 0, header, s3.Private)
+}
+
+// Current claim on the key (nil when there is none).
+func (self *S3Store) claim(key string) (*fillClaim, error) {
+	resp, err := self.Bucket.Head(self.lockKey(key), nil)
+	if err != nil {
+		if s3Err, ok := err.(*s3.Error); ok && (s3Err.StatusCode == 403 || s3Err.StatusCode == 404) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	claim := &fillClaim{
+		Owner: resp.Header.Get(FILL_LOCK_OWNER_META),
+		etag:  resp.Header.Get("ETag"),
+	}
+	claim.Expires, err = time.Parse(time.RFC3339Nano, resp.Header.Get(FILL_LOCK_EXPIRES_META))
+	if err != nil {
+		// Unreadable locks are as good as expired...
+		log.Printf("Invalid fill lock of %s %v", key, err)
+	}
+	return claim, nil
+}
+
+// Lock objects are created with If-None-Match so only one proxy gets them
+// (stores which ignore the condition let every proxy fill).
+func (self *S3Store) ClaimFill(key, owner string, lease time.Duration) (bool, error) {
+	// Second attempt is after removing an expired lock...
+	for attempt := 0; attempt < 2; attempt++ {
+		err := self.putClaim(key, owner, lease, http.Header{"If-None-Match": {"*"}})
+		if err == nil {
+			return true, nil
+		}
+
+		s3Err, ok := err.(*s3.Error)
+		if !ok || (s3Err.StatusCode != 412 && s3Err.StatusCode != 409) {
+			return false, err
+		}
+
+		claim, err := self.claim(key)
+		if err != nil {
+			return false, err
+		}
+		if claim != nil && !claim.Expired() {
+			return claim.Owner == owner, nil
+		}
+
+		err = self.Bucket.Del(self.lockKey(key))
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// The lock object is only replaced if it is still the one we read (If-Match)
+// so a claim taken over in between is not overwritten.
+func (self *S3Store) RenewFill(key, owner string, lease time.Duration) error {
+	claim, err := self.claim(key)
+	if err != nil {
+		return err
+	}
+	if claim == nil || claim.Owner != owner {
+		return errFillLost
+	}
+
+	var condition http.Header
+	if claim.etag != "" {
+		condition = http.Header{"If-Match": {claim.etag}}
+	}
+	err = self.putClaim(key, owner, lease, condition)
+	if s3Err, ok := err.(*s3.Error); ok && (s3Err.StatusCode == 412 || s3Err.StatusCode == 409) {
+		return errFillLost
+	}
+	return err
+}
+
+func (self *S3Store) ReleaseFill(key, owner string) error {
+	claim, err := self.claim(key)
+	if err != nil || claim == nil || claim.Owner != owner {
+		return err
+	}
+	return self.Bucket.Del(self.lockKey(key))
+}
+
+func (self *S3Store) FillClaimed(key string) (bool, error) {
+	claim, err := self.claim(key)
+	if err != nil {
+		return false, err
+	}
+	return claim != nil && !claim.Expired(), nil
+}
+
+func (self *FileStore) lockPath(key string) (string, error) {
+	// Validates the key the same way as for objects...
+	_, _, err := self.paths(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(self.dir, FILE_STORE_LOCK_DIR, filepath.FromSlash(key)+".lock"), nil
+}
+
+// Locks are always written whole so one which cannot be parsed was corrupted
+// by something else. Such a lock is held by nobody in particular until it is
+// a lease old (by its modification time).
+func (self *FileStore) claim(lockPath string, lease time.Duration) (*fillClaim, error) {
+	content, err := ioutil.ReadFile(lockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claim := &fillClaim{}
+	err = json.Unmarshal(content, claim)
+	if err != nil {
+		log.Printf("Invalid fill lock %s %v", lockPath, err)
+		info, err := os.Stat(lockPath)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &fillClaim{Expires: info.ModTime().Add(lease)}, nil
+	}
+	return claim, nil
+}
+
+// Write the claim aside (so the lock is never seen half written). Returns
+// the path of the temporary file which the caller must remove.
+func (self *FileStore) writeClaim(owner string, lease time.Duration) (string, error) {
+	content, err := json.Marshal(&fillClaim{Owner: owner, Expires: time.Now().Add(lease)})
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile(filepath.Join(self.dir, FILE_STORE_TMP_DIR), "lock-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Claims are written aside and linked into place (which fails if the lock
+// exists) so only one proxy gets the lock and it is always complete.
+func (self *FileStore) ClaimFill(key, owner string, lease time.Duration) (bool, error) {
+	lockPath, err := self.lockPath(key)
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(lockPath), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	claimPath, err := self.writeClaim(owner, lease)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(claimPath)
+
+	// Second attempt is after removing an expired lock...
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(claimPath, lockPath)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+
+		claim, err := self.claim(lockPath, lease)
+		if err != nil {
+			return false, err
+		}
+		if claim != nil && !claim.Expired() {
+			return claim.Owner == owner, nil
+		}
+
+		err = os.Remove(lockPath)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (self *FileStore) RenewFill(key, owner string, lease time.Duration) error {
+	lockPath, err := self.lockPath(key)
+	if err != nil {
+		return err
+	}
+
+	// There is no compare and swap for files so a claim taken over between
+	// the check and the rename is still overwritten (which at worst means a
+	// duplicate fill)...
+	claim, err := self.claim(lockPath, lease)
+	if err != nil {
+		return err
+	}
+	if claim == nil || claim.Owner != owner {
+		return errFillLost
+	}
+
+	// Renamed over the lock so it is never half written.
+	claimPath, err := self.writeClaim(owner, lease)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(claimPath)
+	return os.Rename(claimPath, lockPath)
+}
+
+func (self *FileStore) ReleaseFill(key, owner string) error {
+	lockPath, err := self.lockPath(key)
+	if err != nil {
+		return err
+	}
+
+	claim, err := self.claim(lockPath, 0)
+	if err != nil || claim == nil || claim.Owner != owner {
+		return err
+	}
+
+	err = os.Remove(lockPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (self *FileStore) FillClaimed(key string) (bool, error) {
+	lockPath, err := self.lockPath(key)
+	if err != nil {
+		return false, err
+	}
+
+	// Fills are not waited on behind a lock which cannot be parsed (whoever
+	// wrote it may never finish).
+	claim, err := self.claim(lockPath, 0)
+	if err != nil {
+		return false, err
+	}
+	return claim != nil && !claim.Expired(), nil
+}
+
+// Claim on a fill held by this proxy which is renewed until released.
+type fillLease struct {
+	locker FillLocker
+	key    string
+	owner  string
+	done   chan bool
+}
+
+// Claim the fill of the key from the other proxies sharing the store. Returns
+// false when another proxy is filling it. A nil lease (which is safe to
+// release) is returned when fill locks are disabled or fail since the worst
+// that can happen is a duplicate fill.
+func (self *Routes) claimFill(key string) (*fillLease, bool) {
+	locker, ok := self.config.Store.(FillLocker)
+	if !ok || self.config.FillLockLease <= 0 {
+		return nil, true
+	}
+
+	claimed, err := locker.ClaimFill(key, self.config.ProxyID, self.config.FillLockLease)
+	if err != nil {
+		log.Printf("Non fatal error claiming fill of %s %v", key, err)
+		return nil, true
+	}
+	if !claimed {
+		return nil, false
+	}
+
+	lease := &fillLease{
+		locker: locker,
+		key:    key,
+		owner:  self.config.ProxyID,
+		done:   make(chan bool),
+	}
+	go lease.renew(self.config.FillLockLease)
+	return lease, true
+}
+
+func (self *fillLease) renew(duration time.Duration) {
+	ticker := time.NewTicker(duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			err := self.locker.RenewFill(self.key, self.owner, duration)
+			if err == errFillLost {
+				log.Printf("Fill lock of %s was taken over no longer renewing", self.key)
+				return
+			}
+			if err != nil {
+				log.Printf("Non fatal error renewing fill lock of %s %v", self.key, err)
+			}
+		}
+	}
+}
+
+func (self *fillLease) Release() {
+	if self == nil {
+		return
+	}
+
+	close(self.done)
+	err := self.locker.ReleaseFill(self.key, self.owner)
+	if err != nil {
+		log.Printf("Non fatal error releasing fill lock of %s %v", self.key, err)
+	}
+}
+
+// Wait for another proxy to fill the key (local requests for the key wait on
+// the lock as they would for `pullFromSource`).
+func (self *Routes) waitForRemoteFill(
+	key string,
+	lock *chan bool,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	defer self.requests.Complete(key, lock)
+	locker := self.config.Store.(FillLocker)
+
+	self.requests.AddWaiter()
+	defer self.requests.RemoveWaiter()
+
+	now := time.Now()
+	timeout := time.After(self.maxWait(req))
+	ticker := time.NewTicker(self.config.FillLockPoll)
+	defer ticker.Stop()
+
+	log.Printf("Another proxy is pulling %s waiting...", key)
+	for {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			log.Printf("Timed out while waiting for remote upload of %s", key)
+			self.metrics.Send(self.metricsFactory.CacheTimeout(time.Now().Sub(now)))
+			self.redirectToSource(res, req)
+			return
+		}
+
+		// Checked before the object so a fill which completes in between is
+		// not missed.
+		claimed, err := locker.FillClaimed(key)
+		if err != nil {
+			log.Printf("Non fatal error checking fill lock of %s %v", key, err)
+			claimed = true
+		}
+
+		object, err := self.config.Store.Stat(key)
+		if err != nil {
+			log.Printf("Non fatal error checking if object is cached %v", err)
+		}
+
+		if object != nil {
+			waited := time.Now().Sub(now)
+			log.Printf("%s ready waited for remote upload %v", key, waited)
+			self.index.Set(key, true)
+			self.accessed.Touch(key)
+			self.config.Store.Serve(key, res, req)
+			self.metrics.Send(self.metricsFactory.WaitedForUpload(waited))
+			return
+		}
+
+		if !claimed {
+			// The other proxy gave up (or died) without caching anything...
+			log.Printf("Remote upload of %s did not create a cache", key)
+			self.metrics.Send(self.metricsFactory.WaitedForUploadMiss(time.Now().Sub(now)))
+			self.redirectToSource(res, req)
+			return
+		}
+	}
+}
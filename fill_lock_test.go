@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Behaviour every FillLocker must have.
+func testFillLocker(t *testing.T, locker FillLocker) {
+	claimed, err := locker.ClaimFill("production/a", "one", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim an unclaimed key %v", err)
+	}
+
+	claimed, err = locker.ClaimFill("production/a", "two", time.Hour)
+	if err != nil || claimed {
+		t.Fatalf("Expected a held claim to be refused %v", err)
+	}
+
+	claimed, err = locker.FillClaimed("production/a")
+	if err != nil || !claimed {
+		t.Fatalf("Expected key to be claimed %v", err)
+	}
+
+	// Only the owner can release...
+	err = locker.ReleaseFill("production/a", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ = locker.FillClaimed("production/a")
+	if !claimed {
+		t.Fatal("Expected claim to survive a release by someone else")
+	}
+
+	err = locker.ReleaseFill("production/a", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ = locker.FillClaimed("production/a")
+	if claimed {
+		t.Fatal("Expected claim to be released")
+	}
+
+	// Expired claims can be taken over...
+	claimed, err = locker.ClaimFill("production/b", "one", -time.Second)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim an unclaimed key %v", err)
+	}
+	claimed, _ = locker.FillClaimed("production/b")
+	if claimed {
+		t.Fatal("Expected an expired claim to not count")
+	}
+	claimed, err = locker.ClaimFill("production/b", "two", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to take over an expired claim %v", err)
+	}
+
+	// ...but not once renewed.
+	claimed, err = locker.ClaimFill("production/c", "one", -time.Second)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim an unclaimed key %v", err)
+	}
+	err = locker.RenewFill("production/c", "one", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = locker.ClaimFill("production/c", "two", time.Hour)
+	if err != nil || claimed {
+		t.Fatalf("Expected a renewed claim to be refused %v", err)
+	}
+
+	// Claims taken over are not renewed by the previous owner...
+	err = locker.RenewFill("production/b", "one", time.Hour)
+	if err != errFillLost {
+		t.Fatalf("Expected renewing a lost claim to fail got %v", err)
+	}
+	claimed, err = locker.ClaimFill("production/b", "two", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the claim to still be held by the new owner %v", err)
+	}
+}
+
+func TestFileStoreFillLocker(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	testFillLocker(t, store)
+}
+
+func TestFileStoreClaimFillRace(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	// Claims racing a lock being created must see it complete (rather then
+	// empty and so expired)...
+	for round := 0; round < 50; round++ {
+		key := fmt.Sprintf("production/race-%d", round)
+		claimed := make(chan bool, 8)
+		wait := sync.WaitGroup{}
+		for owner := 0; owner < cap(claimed); owner++ {
+			wait.Add(1)
+			go func(owner int) {
+				defer wait.Done()
+				ok, err := store.ClaimFill(key, fmt.Sprintf("owner-%d", owner), time.Hour)
+				if err != nil {
+					t.Error(err)
+				}
+				claimed <- ok
+			}(owner)
+		}
+		wait.Wait()
+		close(claimed)
+
+		winners := 0
+		for ok := range claimed {
+			if ok {
+				winners++
+			}
+		}
+		if winners != 1 {
+			t.Fatalf("Expected a single claim of %s got %d", key, winners)
+		}
+	}
+}
+
+func TestFileStoreInvalidFillLock(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	lockPath, err := store.lockPath("production/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(lockPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(lockPath, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := store.ClaimFill("production/a", "one", time.Hour)
+	if err != nil || claimed {
+		t.Fatalf("Expected an unreadable lock to be held for a lease %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(lockPath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = store.ClaimFill("production/a", "one", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected an unreadable lock older then the lease to be replaced %v", err)
+	}
+}
+
+// Fake s3 which only knows how to write objects conditionally (which s3test
+// does not).
+type conditionalS3 struct {
+	sync.Mutex
+	objects map[string]http.Header
+	puts    int
+
+	// Called (while locked) after every HEAD.
+	afterHead func(self *conditionalS3, path string)
+}
+
+func (self *conditionalS3) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	ioutil.ReadAll(req.Body)
+
+	header, exists := self.objects[req.URL.Path]
+	switch req.Method {
+	case "PUT":
+		ifMatch := req.Header.Get("If-Match")
+		if (exists && req.Header.Get("If-None-Match") == "*") ||
+			(ifMatch != "" && (!exists || header.Get("ETag") != ifMatch)) {
+			res.WriteHeader(412)
+			res.Write([]byte("<Error><Code>PreconditionFailed</Code></Error>"))
+			return
+		}
+		self.puts++
+		header = req.Header
+		header.Set("ETag", fmt.Sprintf(`"%d"`, self.puts))
+		self.objects[req.URL.Path] = header
+		res.Header().Set("ETag", header.Get("ETag"))
+	case "HEAD":
+		if !exists {
+			res.WriteHeader(404)
+			return
+		}
+		for name, values := range header {
+			res.Header()[name] = values
+		}
+		if self.afterHead != nil {
+			self.afterHead(self, req.URL.Path)
+		}
+	case "DELETE":
+		delete(self.objects, req.URL.Path)
+		res.WriteHeader(204)
+	}
+}
+
+func newConditionalS3Store(fake *conditionalS3) (*S3Store, func()) {
+	server := httptest.NewServer(fake)
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL,
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{}, region).Bucket("bucket")
+	return NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE), server.Close
+}
+
+func TestS3StoreFillLocker(t *testing.T) {
+	store, cleanup := newConditionalS3Store(&conditionalS3{objects: map[string]http.Header{}})
+	defer cleanup()
+	testFillLocker(t, store)
+}
+
+func TestS3StoreRenewFillTakenOver(t *testing.T) {
+	fake := &conditionalS3{objects: map[string]http.Header{}}
+	store, cleanup := newConditionalS3Store(fake)
+	defer cleanup()
+
+	claimed, err := store.ClaimFill("production/a", "one", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim an unclaimed key %v", err)
+	}
+
+	// Another proxy takes the claim over between our check and renewal...
+	fake.afterHead = func(self *conditionalS3, path string) {
+		header := http.Header{}
+		header.Set(FILL_LOCK_OWNER_META, "two")
+		header.Set(FILL_LOCK_EXPIRES_META, time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano))
+		header.Set("ETag", `"taken"`)
+		self.objects[path] = header
+		self.afterHead = nil
+	}
+
+	err = store.RenewFill("production/a", "one", time.Hour)
+	if err != errFillLost {
+		t.Fatalf("Expected renewing a claim taken over to fail got %v", err)
+	}
+	claim, err := store.claim("production/a")
+	if err != nil || claim == nil || claim.Owner != "two" {
+		t.Fatalf("Expected the claim to still be held by two got %v %v", claim, err)
+	}
+}
+
+func TestFillLeaseStopsRenewingLostClaim(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	claimed, err := store.ClaimFill("production/a", "one", -time.Second)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim an unclaimed key %v", err)
+	}
+	claimed, err = store.ClaimFill("production/a", "two", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected to take over an expired claim %v", err)
+	}
+
+	lease := &fillLease{locker: store, key: "production/a", owner: "one", done: make(chan bool)}
+	stopped := make(chan bool)
+	go func() {
+		lease.renew(30 * time.Millisecond)
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		close(lease.done)
+		t.Fatal("Expected the lease to stop renewing a lost claim")
+	}
+
+	claimed, err = store.ClaimFill("production/a", "two", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the claim to still be held by two %v", err)
+	}
+}
+
+func TestIntegrationRemoteFill(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	proxy.config.Store = store
+	proxy.config.FillLockLease = time.Minute
+	proxy.config.FillLockPoll = 10 * time.Millisecond
+	proxy.reset()
+
+	// Another proxy is filling the key...
+	claimed, err := store.ClaimFill("production/remote", "other", time.Minute)
+	if err != nil || !claimed {
+		t.Fatalf("Cannot claim fill %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		putString(t, store, "production/remote", "xfoo", nil)
+		store.ReleaseFill("production/remote", "other")
+	}()
+
+	res := proxy.get("/remote", nil)
+	if res.Code != 200 || res.Body.String() != "xfoo" {
+		t.Fatalf("Expected the remotely filled object got %d %s", res.Code, res.Body.String())
+	}
+	if proxy.sourceCount("/remote") != 0 {
+		t.Fatal("Expected the source to only be contacted by the other proxy")
+	}
+
+	// Our own fills claim (and release) the key too...
+	res = proxy.get("/local", nil)
+	if res.Code != 200 || proxy.sourceCount("/local") != 1 {
+		t.Fatalf("Expected a local fill got %d", res.Code)
+	}
+	claimed, _ = store.FillClaimed("production/local")
+	if claimed {
+		t.Fatal("Expected the claim to be released after the fill")
+	}
+}
+
+func TestIntegrationRemoteFillFailed(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	proxy.config.Store = store
+	proxy.config.FillLockLease = time.Minute
+	proxy.config.FillLockPoll = 10 * time.Millisecond
+	proxy.reset()
+
+	claimed, err := store.ClaimFill("production/failed", "other", time.Minute)
+	if err != nil || !claimed {
+		t.Fatalf("Cannot claim fill %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.ReleaseFill("production/failed", "other")
+	}()
+
+	res := proxy.get("/failed", nil)
+	proxy.expectRedirect(res, proxy.source.URL+"/failed")
+	if proxy.series()[CACHE_WAITED_FOR_UPLOAD_MISS] != 1 {
+		t.Fatalf("Expected a waited for upload miss got %v", proxy.series())
+	}
+}
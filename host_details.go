@@ -35,7 +35,7 @@ func getMetadata(base string, key string) (string, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Unknown metadata key %s (%d)", resp.StatusCode)
+		return "", fmt.Errorf("Unknown metadata key %s (%d)", key, resp.StatusCode)
 	}
 
 	content, err := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Proxy wired up to a fake s3 (as the cache bucket) and an httptest source.
+type testProxy struct {
+	t       *testing.T
+	s3      *s3test.Server
+	bucket  *s3.Bucket
+	source  *httptest.Server
+	config  *ProxyConfig
+	metrics *Metrics
+	routes  Routes
+
+	sync.Mutex
+	// Number of requests the source has seen by path.
+	sourceRequests map[string]int
+}
+
+// The handler is called for every source request (after it is counted).
+func newTestProxy(t *testing.T, handler http.HandlerFunc) *testProxy {
+	server, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL(),
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{}, region).Bucket("bucket")
+	err = bucket.PutBucket(s3.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &testProxy{
+		t:              t,
+		s3:             server,
+		bucket:         bucket,
+		sourceRequests: map[string]int{},
+	}
+
+	proxy.source = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		proxy.Lock()
+		proxy.sourceRequests[req.URL.Path]++
+		proxy.Unlock()
+		handler(res, req)
+	}))
+
+	sourceURL, _ := url.Parse(proxy.source.URL)
+	proxy.config = &ProxyConfig{
+		Sources:            []*url.URL{sourceURL},
+		Store:              NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE),
+		Prefix:             "production",
+		MultipartThreshold: MAX_SINGLE_PUT_SIZE,
+		MultipartPartSize:  MIN_MULTIPART_PART_SIZE,
+		NegativeCacheTTL:   time.Minute,
+		MaxSpoolSize:       1024,
+		TeeMaxClientLag:    1024 * 1024 * 1024,
+		MaxSourcePullWait:  5 * time.Second,
+		PassthroughHeaders: defaultPassthroughHeaders,
+		ProxyID:            "test-proxy",
+	}
+
+	// Active so the series end up in pendingWrites (they are never sent since
+	// the metrics were not started).
+	proxy.metrics = &Metrics{Active: true}
+	proxy.reset()
+	return proxy
+}
+
+// Rebuild the routes (after changing the config).
+func (self *testProxy) reset() {
+	metricsFactory := NewMetricFactory(&HostDetails{}, self.config)
+	self.routes = NewRoutes(self.config, newRequestMutex(), newAccessLog(), newStoreKeyIndex([]*ProxyConfig{self.config}), self.metrics, &metricsFactory)
+}
+
+func (self *testProxy) Close() {
+	self.source.Close()
+	self.s3.Quit()
+}
+
+func (self *testProxy) get(path string, header http.Header) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://proxy"+path, nil)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	self.routes.ServeHTTP(res, req)
+	return res
+}
+
+func (self *testProxy) sourceCount(path string) int {
+	self.Lock()
+	defer self.Unlock()
+	return self.sourceRequests[path]
+}
+
+// Number of each series sent so far.
+func (self *testProxy) series() map[string]int {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+
+	counts := map[string]int{}
+	for _, series := range self.metrics.pendingWrites {
+		counts[series.Name]++
+	}
+	return counts
+}
+
+func (self *testProxy) expectRedirect(res *httptest.ResponseRecorder, location string) {
+	if res.Code != 302 {
+		self.t.Fatalf("Expected redirect got %d %s", res.Code, res.Body.String())
+	}
+	if got := res.Header().Get("Location"); got != location {
+		self.t.Fatalf("Expected redirect to %s got %s", location, got)
+	}
+}
+
+func (self *testProxy) expectCached(key, content string) {
+	cached, err := self.bucket.Get(key)
+	if err != nil {
+		self.t.Fatalf("Expected %s in bucket %v", key, err)
+	}
+	if string(cached) != content {
+		self.t.Fatalf("Unexpected cached content %s", cached)
+	}
+}
+
+func serveXFoo(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain")
+	res.Write([]byte("xfoo"))
+}
+
+func TestIntegrationCacheHit(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	err := proxy.bucket.Put("production/hit", []byte("xfoo"), "text/plain", s3.PublicRead, s3.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := proxy.get("/hit", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/hit"))
+
+	if proxy.sourceCount("/hit") != 0 {
+		t.Fatal("Cache hit should not contact the source")
+	}
+	if proxy.series()[CACHE_HIT_SERIES] != 1 {
+		t.Fatalf("Expected a cache hit metric got %v", proxy.series())
+	}
+}
+
+func TestIntegrationMissAndFill(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	res := proxy.get("/miss", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/miss"))
+	proxy.expectCached("production/miss", "xfoo")
+
+	// Second request is a plain hit...
+	res = proxy.get("/miss", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/miss"))
+
+	if proxy.sourceCount("/miss") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/miss"))
+	}
+
+	series := proxy.series()
+	if series[CACHE_UPLOAD] != 1 || series[CACHE_WAITED_FOR_UPLOAD] != 1 || series[CACHE_HIT_SERIES] != 1 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationChunkedSource(t *testing.T) {
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("xf"))
+		res.(http.Flusher).Flush()
+		res.Write([]byte("oo"))
+	})
+	defer proxy.Close()
+
+	res := proxy.get("/chunked", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/chunked"))
+	proxy.expectCached("production/chunked", "xfoo")
+}
+
+func TestIntegrationConcurrentWaiters(t *testing.T) {
+	release := make(chan bool)
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	const waiters = 5
+	responses := make([]*httptest.ResponseRecorder, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = proxy.get("/concurrent", nil)
+		}(i)
+	}
+
+	// Wait for the fill to start before letting it finish...
+	for proxy.sourceCount("/concurrent") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, res := range responses {
+		proxy.expectRedirect(res, proxy.bucket.URL("production/concurrent"))
+	}
+
+	if proxy.sourceCount("/concurrent") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/concurrent"))
+	}
+	if proxy.series()[CACHE_UPLOAD] != 1 {
+		t.Fatalf("Expected a single upload got %v", proxy.series())
+	}
+}
+
+func TestIntegrationWaitTimeout(t *testing.T) {
+	release := make(chan bool)
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	res := proxy.get("/slow", http.Header{MAX_WAIT_HEADER: {"20ms"}})
+	proxy.expectRedirect(res, proxy.source.URL+"/slow")
+
+	if proxy.series()[CACHE_TIMEOUT] != 1 {
+		t.Fatalf("Expected a timeout metric got %v", proxy.series())
+	}
+
+	// The fill carries on in the background...
+	close(release)
+	for proxy.series()[CACHE_UPLOAD] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	proxy.expectCached("production/slow", "xfoo")
+}
+
+func TestIntegrationWaitCannotExceedMax(t *testing.T) {
+	release := make(chan bool)
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+	defer close(release)
+
+	proxy.config.MaxSourcePullWait = 20 * time.Millisecond
+	proxy.reset()
+
+	start := time.Now()
+	res := proxy.get("/slow", http.Header{MAX_WAIT_HEADER: {"1m"}})
+	proxy.expectRedirect(res, proxy.source.URL+"/slow")
+
+	if waited := time.Now().Sub(start); waited > 5*time.Second {
+		t.Fatalf("Waited %v which is longer then the max", waited)
+	}
+}
+
+func TestIntegrationSourceError(t *testing.T) {
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		http.NotFound(res, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		res := proxy.get("/missing", nil)
+		proxy.expectRedirect(res, proxy.source.URL+"/missing")
+	}
+
+	// Only the first request goes to the source (the rest are negative hits).
+	if proxy.sourceCount("/missing") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/missing"))
+	}
+
+	series := proxy.series()
+	if series[CACHE_WAITED_FOR_UPLOAD_MISS] != 1 || series[NEGATIVE_CACHE_HIT] != 2 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+
+	exists, _ := proxy.bucket.Exists("production/missing")
+	if exists {
+		t.Fatal("Source errors should not be cached")
+	}
+}
+
+func TestIntegrationSourceUnreachable(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+	proxy.source.Close()
+
+	res := proxy.get("/down", nil)
+	proxy.expectRedirect(res, proxy.source.URL+"/down")
+
+	if proxy.series()[SOURCE_ERR] != 1 {
+		t.Fatalf("Expected a source error metric got %v", proxy.series())
+	}
+}
+
+// Source serving the current version of every object with an ETag (and
+// answering conditional requests for it).
+type versionedSource struct {
+	sync.Mutex
+	content string
+	etag    string
+}
+
+func (self *versionedSource) Set(content, etag string) {
+	self.Lock()
+	defer self.Unlock()
+	self.content = content
+	self.etag = etag
+}
+
+func (self *versionedSource) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	res.Header().Set("ETag", self.etag)
+	if req.Header.Get("If-None-Match") == self.etag {
+		res.WriteHeader(304)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain")
+	res.Write([]byte(self.content))
+}
+
+// Test proxy whose (versioned) source was already used to cache /versioned
+// and which revalidates everything it serves.
+func newTestRevalidatingProxy(t *testing.T) (*testProxy, *versionedSource) {
+	source := &versionedSource{content: "xfoo", etag: `"v1"`}
+	proxy := newTestProxy(t, source.ServeHTTP)
+
+	res := proxy.get("/versioned", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/versioned"))
+	proxy.expectCached("production/versioned", "xfoo")
+
+	proxy.config.RevalidateAfter = time.Nanosecond
+	proxy.reset()
+	return proxy, source
+}
+
+func TestIntegrationRevalidateUnchanged(t *testing.T) {
+	proxy, _ := newTestRevalidatingProxy(t)
+	defer proxy.Close()
+
+	res := proxy.get("/versioned", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/versioned"))
+	proxy.expectCached("production/versioned", "xfoo")
+
+	// Only the conditional request went to the source...
+	if proxy.sourceCount("/versioned") != 2 {
+		t.Fatalf("Expected the fill and a revalidation got %d", proxy.sourceCount("/versioned"))
+	}
+	series := proxy.series()
+	if series[CACHE_REVALIDATE] != 1 || series[CACHE_UPLOAD] != 1 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationRevalidateChanged(t *testing.T) {
+	proxy, source := newTestRevalidatingProxy(t)
+	defer proxy.Close()
+
+	source.Set("xbar", `"v2"`)
+	res := proxy.get("/versioned", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/versioned"))
+	proxy.expectCached("production/versioned", "xbar")
+
+	object, err := proxy.config.Store.Stat("production/versioned")
+	if err != nil || object == nil {
+		t.Fatalf("Expected cached object %v", err)
+	}
+	if etag := object.Header.Get(SOURCE_ETAG_META); etag != `"v2"` {
+		t.Fatalf("Expected the new etag to be recorded got %s", etag)
+	}
+
+	// The fill, the revalidation and the refill...
+	if proxy.sourceCount("/versioned") != 3 {
+		t.Fatalf("Expected the object to be refilled got %d", proxy.sourceCount("/versioned"))
+	}
+	series := proxy.series()
+	if series[CACHE_REVALIDATE] != 1 || series[CACHE_UPLOAD] != 2 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationRevalidateSourceUnreachable(t *testing.T) {
+	proxy, _ := newTestRevalidatingProxy(t)
+	defer proxy.Close()
+	proxy.source.Close()
+
+	// The cached copy is served as is...
+	res := proxy.get("/versioned", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/versioned"))
+	proxy.expectCached("production/versioned", "xfoo")
+
+	series := proxy.series()
+	if series[CACHE_REVALIDATE] != 0 || series[CACHE_HIT_SERIES] != 1 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationOriginFailover(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "unavailable", 503)
+	}))
+	defer failing.Close()
+
+	proxy.config.Sources = parsePeers(t, failing.URL, proxy.source.URL)
+	proxy.reset()
+
+	res := proxy.get("/failover", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/failover"))
+	proxy.expectCached("production/failover", "xfoo")
+
+	if proxy.sourceCount("/failover") != 1 {
+		t.Fatalf("Expected the second origin to be used got %d", proxy.sourceCount("/failover"))
+	}
+	if proxy.series()[SOURCE_ERR] != 1 {
+		t.Fatalf("Expected a source error for the first origin got %v", proxy.series())
+	}
+}
+
+func TestIntegrationUploadError(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	// A bucket which does not exist fails every upload.
+	missing := s3.New(aws.Auth{}, proxy.bucket.Region).Bucket("missing")
+	proxy.config.Store = NewS3Store(missing, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE)
+	proxy.reset()
+
+	res := proxy.get("/upload", nil)
+	proxy.expectRedirect(res, proxy.source.URL+"/upload")
+
+	series := proxy.series()
+	if series[CACHE_UPLOAD_ERR] != 1 || series[CACHE_UPLOAD] != 0 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationVerifyFailure(t *testing.T) {
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		// The sha256 of something other then what is served...
+		res.Header().Set(SOURCE_SHA256_HEADER, EMPTY_PAYLOAD_SHA256)
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	proxy.config.VerifySHA256 = true
+	proxy.reset()
+
+	res := proxy.get("/corrupt", nil)
+	proxy.expectRedirect(res, proxy.source.URL+"/corrupt")
+
+	// The upload went through but was removed once it failed verification.
+	exists, _ := proxy.bucket.Exists("production/corrupt")
+	if exists {
+		t.Fatal("Expected the corrupt object to be removed")
+	}
+	series := proxy.series()
+	if series[CACHE_VERIFY_ERR] != 1 || series[CACHE_UPLOAD_ERR] != 1 || series[CACHE_UPLOAD] != 0 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationTee(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	proxy.config.Tee = true
+	proxy.reset()
+
+	res := proxy.get("/tee", nil)
+	if res.Code != 200 || res.Body.String() != "xfoo" {
+		t.Fatalf("Expected source content got %d %s", res.Code, res.Body.String())
+	}
+	proxy.expectCached("production/tee", "xfoo")
+}
+
+func TestIntegrationTeeRange(t *testing.T) {
+	var sourceRange string
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		sourceRange = req.Header.Get("Range")
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	proxy.config.Tee = true
+	proxy.reset()
+
+	// The range is sliced out of the source stream...
+	res := proxy.get("/tee-range", http.Header{"Range": {"bytes=1-2"}})
+	if res.Code != 206 || res.Body.String() != "fo" {
+		t.Fatalf("Expected partial content got %d %s", res.Code, res.Body.String())
+	}
+	if contentRange := res.Header().Get("Content-Range"); contentRange != "bytes 1-2/4" {
+		t.Fatalf("Unexpected content range %s", contentRange)
+	}
+	if contentLength := res.Header().Get("Content-Length"); contentLength != "2" {
+		t.Fatalf("Unexpected content length %s", contentLength)
+	}
+
+	// ...while the full object is cached.
+	proxy.expectCached("production/tee-range", "xfoo")
+	if sourceRange != "" || proxy.sourceCount("/tee-range") != 1 {
+		t.Fatalf("Expected a single full source request got range %s", sourceRange)
+	}
+}
+
+func TestIntegrationTeeIfRange(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	proxy.config.Tee = true
+	proxy.reset()
+
+	// We cannot tell if the source still matches the client's validator so
+	// the client is redirected to the cached copy once it is filled.
+	res := proxy.get("/tee-if-range", http.Header{
+		"Range":    {"bytes=1-2"},
+		"If-Range": {`"some-etag"`},
+	})
+	proxy.expectRedirect(res, proxy.bucket.URL("production/tee-if-range"))
+	if res.Header().Get("Content-Range") != "" {
+		t.Fatalf("Expected no range to be served got %s", res.Header().Get("Content-Range"))
+	}
+	proxy.expectCached("production/tee-if-range", "xfoo")
+	if proxy.sourceCount("/tee-if-range") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/tee-if-range"))
+	}
+}
+
+func TestIntegrationFileStore(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	proxy.config.Store = store
+	proxy.reset()
+
+	for i := 0; i < 2; i++ {
+		res := proxy.get("/local", nil)
+		if res.Code != 200 {
+			t.Fatalf("Expected file store to serve the object got %d", res.Code)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != "xfoo" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+	}
+
+	if proxy.sourceCount("/local") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/local"))
+	}
+}
+
+// Put a disk cache in front of the bucket of the test proxy.
+func useTestDiskCache(t *testing.T, proxy *testProxy) func() {
+	dir, err := ioutil.TempDir("", "disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskCache, err := NewDiskCache(dir, 1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.config.DiskCache = diskCache
+	proxy.reset()
+	return func() { os.RemoveAll(dir) }
+}
+
+func TestIntegrationDiskCacheHit(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+	defer useTestDiskCache(t, proxy)()
+
+	proxy.get("/disk", nil)
+	proxy.expectCached("production/disk", "xfoo")
+
+	// The bucket has it too but the copy on disk is served directly...
+	res := proxy.get("/disk", nil)
+	if res.Code != 200 || res.Body.String() != "xfoo" {
+		t.Fatalf("Expected the object from disk got %d %s", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("Expected the source headers from disk got %v", res.Header())
+	}
+
+	if proxy.sourceCount("/disk") != 1 {
+		t.Fatalf("Expected a single source request got %d", proxy.sourceCount("/disk"))
+	}
+	series := proxy.series()
+	if series[DISK_CACHE_HIT_SERIES] != 1 || series[CACHE_HIT_SERIES] != 0 {
+		t.Fatalf("Unexpected metrics %v", series)
+	}
+}
+
+func TestIntegrationRangeFromDiskCache(t *testing.T) {
+	var sourceRange string
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		sourceRange = req.Header.Get("Range")
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+	defer useTestDiskCache(t, proxy)()
+
+	// A ranged miss still fills the full object...
+	proxy.get("/ranged", http.Header{"Range": {"bytes=1-2"}})
+	proxy.expectCached("production/ranged", "xfoo")
+	if sourceRange != "" {
+		t.Fatalf("Expected the full object from the source got range %s", sourceRange)
+	}
+
+	// ...and ranges are sliced out of the copy on disk.
+	res := proxy.get("/ranged", http.Header{"Range": {"bytes=1-2"}})
+	if res.Code != 206 || res.Body.String() != "fo" {
+		t.Fatalf("Expected partial content got %d %s", res.Code, res.Body.String())
+	}
+	if contentRange := res.Header().Get("Content-Range"); contentRange != "bytes 1-2/4" {
+		t.Fatalf("Unexpected content range %s", contentRange)
+	}
+
+	if proxy.sourceCount("/ranged") != 1 || proxy.series()[DISK_CACHE_HIT_SERIES] != 1 {
+		t.Fatalf("Expected a disk hit got %d source requests %v", proxy.sourceCount("/ranged"), proxy.series())
+	}
+}
+
+func TestIntegrationPrivateBucket(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	proxy.config.Private = true
+	proxy.config.SignedURLExpiry = time.Hour
+	proxy.config.Store = configuredS3Store(proxy.bucket, proxy.config)
+	proxy.reset()
+
+	res := proxy.get("/private", nil)
+	if res.Code != 302 {
+		t.Fatalf("Expected redirect got %d", res.Code)
+	}
+
+	location, err := url.Parse(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Path != "/bucket/production/private" {
+		t.Fatalf("Unexpected redirect %s", location)
+	}
+
+	expires, err := strconv.ParseInt(location.Query().Get("Expires"), 10, 64)
+	if err != nil || location.Query().Get("Signature") == "" {
+		t.Fatalf("Expected signed redirect got %s", location)
+	}
+	if remaining := time.Unix(expires, 0).Sub(time.Now()); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Fatalf("Unexpected signed url expiry %v", remaining)
+	}
+
+	proxy.expectCached("production/private", "xfoo")
+}
+
+func TestIntegrationSignedSource(t *testing.T) {
+	var authorization, contentSHA256 string
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		contentSHA256 = req.Header.Get("X-Amz-Content-Sha256")
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	proxy.config.SourceRegion = "us-west-2"
+	proxy.config.SourceAuth = aws.Auth{AccessKey: "proxy-key", SecretKey: "secret"}
+	proxy.reset()
+
+	res := proxy.get("/signed", http.Header{"Authorization": {"client credentials"}})
+	proxy.expectRedirect(res, proxy.bucket.URL("production/signed"))
+
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=proxy-key/") ||
+		!strings.Contains(authorization, "/us-west-2/s3/aws4_request") {
+		t.Fatalf("Expected source request signed by the proxy got %s", authorization)
+	}
+	if contentSHA256 != EMPTY_PAYLOAD_SHA256 {
+		t.Fatalf("Unexpected payload hash %s", contentSHA256)
+	}
+}
+
+func TestIntegrationObjectMetadata(t *testing.T) {
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("ETag", `"source-etag"`)
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	proxy.config.Metadata = map[string]string{"team": "releng"}
+	proxy.reset()
+
+	res := proxy.get("/meta", nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production/meta"))
+
+	object, err := proxy.config.Store.Stat("production/meta")
+	if err != nil || object == nil {
+		t.Fatalf("Expected production/meta in bucket %v", err)
+	}
+
+	expected := map[string]string{
+		"x-amz-meta-team":  "releng",
+		SOURCE_ETAG_META:   `"source-etag"`,
+		PROXY_VERSION_META: version,
+	}
+	for name, value := range expected {
+		if got := object.Header.Get(name); got != value {
+			t.Errorf("Expected %s to be %s got %s", name, value, got)
+		}
+	}
+	if object.Header.Get(FILL_TIME_META) == "" {
+		t.Error("Expected the fill time to be recorded")
+	}
+}
+
+func TestIntegrationPassthroughHeaders(t *testing.T) {
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Disposition", `attachment; filename="xfoo.txt"`)
+		res.Header().Set("Cache-Control", "max-age=3600")
+		res.Header().Set("X-Amz-Meta-Build", "42")
+		res.Header().Set("X-Internal", "secret")
+		serveXFoo(res, req)
+	})
+	defer proxy.Close()
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+	proxy.config.Store = store
+	proxy.reset()
+
+	// Once from the fill and once as a plain hit...
+	for i := 0; i < 2; i++ {
+		res := proxy.get("/headers", nil)
+		if res.Code != 200 {
+			t.Fatalf("Expected file store to serve the object got %d", res.Code)
+		}
+
+		expected := map[string]string{
+			"Content-Type":        "text/plain",
+			"Content-Disposition": `attachment; filename="xfoo.txt"`,
+			"Cache-Control":       "max-age=3600",
+			"X-Amz-Meta-Build":    "42",
+			"X-Internal":          "",
+		}
+		for name, value := range expected {
+			if got := res.Header().Get(name); got != value {
+				t.Errorf("Expected %s to be %q got %q", name, value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Last time keys were served or filled by this proxy. Shared by the routes of
+// a store (and kept across reloads) like the requestMutex. Objects which were
+// not accessed since the proxy started fall back to their fill time. Nothing
+// is shared with other proxies so a janitor will evict keys which only other
+// replicas of a shared store are serving.
+type accessLog struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{times: make(map[string]time.Time)}
+}
+
+func (self *accessLog) Touch(key string) {
+	self.Lock()
+	defer self.Unlock()
+	self.times[key] = time.Now()
+}
+
+// Last access of the object (or its last modification if later).
+func (self *accessLog) LastUsed(object *CacheObject) time.Time {
+	self.Lock()
+	defer self.Unlock()
+
+	if accessed := self.times[object.Key]; accessed.After(object.LastModified) {
+		return accessed
+	}
+	return object.LastModified
+}
+
+func (self *accessLog) Remove(key string) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.times, key)
+}
+
+type objectsByLastUsed struct {
+	objects  []*CacheObject
+	lastUsed []time.Time
+}
+
+func (self objectsByLastUsed) Len() int { return len(self.objects) }
+func (self objectsByLastUsed) Swap(i, j int) {
+	self.objects[i], self.objects[j] = self.objects[j], self.objects[i]
+	self.lastUsed[i], self.lastUsed[j] = self.lastUsed[j], self.lastUsed[i]
+}
+func (self objectsByLastUsed) Less(i, j int) bool {
+	return self.lastUsed[i].Before(self.lastUsed[j])
+}
+
+// Whether the janitor has anything to do for these routes.
+func (self *Routes) janitorEnabled() bool {
+	return self.config.ExpireAfter > 0 || self.config.MaxStoreSize > 0
+}
+
+// Sweep the store every JanitorInterval until stop is closed.
+func (self *Routes) RunJanitor(stop <-chan bool) {
+	ticker := time.NewTicker(self.config.JanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := self.Sweep()
+			if err != nil {
+				log.Printf("Non fatal error sweeping %s %v", self.config.Store.Name(), err)
+			}
+		}
+	}
+}
+
+// Delete the objects under our prefix which were not used for ExpireAfter and
+// then the least recently used ones until the rest fit in MaxStoreSize.
+func (self *Routes) Sweep() error {
+	objects := objectsByLastUsed{}
+	var totalSize int64
+
+	err := self.config.Store.List(self.storePrefix(), func(object *CacheObject) bool {
+		// Fill locks come and go on their own...
+		if strings.HasPrefix(object.Key, FILL_LOCK_PREFIX) {
+			return true
+		}
+		objects.objects = append(objects.objects, object)
+		objects.lastUsed = append(objects.lastUsed, self.accessed.LastUsed(object))
+		totalSize += object.Size
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(objects)
+
+	now := time.Now()
+	keys := []string{}
+	var evictedSize int64
+	for i, object := range objects.objects {
+		expired := self.config.ExpireAfter > 0 && now.Sub(objects.lastUsed[i]) > self.config.ExpireAfter
+		overBudget := self.config.MaxStoreSize > 0 && totalSize-evictedSize > self.config.MaxStoreSize
+		if !expired && !overBudget {
+			// Everything after this was used more recently...
+			break
+		}
+
+		// Being filled right now so not going anywhere...
+		if self.requests.Get(object.Key) != nil {
+			continue
+		}
+
+		keys = append(keys, object.Key)
+		evictedSize += object.Size
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	log.Printf("Evicting %d objects (%d bytes) from %s", len(keys), evictedSize, self.config.Store.Name())
+	err = self.config.Store.DeleteMulti(keys)
+
+	// Some of the keys may have been deleted even on error so forget them all.
+	for _, key := range keys {
+		self.index.Remove(key)
+		self.accessed.Remove(key)
+		if self.config.DiskCache != nil {
+			self.config.DiskCache.Remove(self.diskKey(key))
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	self.metrics.Send(self.metricsFactory.CacheEvict(len(keys), evictedSize))
+	return nil
+}
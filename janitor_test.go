@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestJanitorRoutes(t *testing.T, config *ProxyConfig) *Routes {
+	metricsFactory := NewMetricFactory(&HostDetails{}, config)
+	routes := NewRoutes(config, newRequestMutex(), newAccessLog(), newStoreKeyIndex([]*ProxyConfig{config}), &Metrics{}, &metricsFactory)
+	return &routes
+}
+
+// Put an object into the file store which was last modified age ago.
+func putAged(t *testing.T, store *FileStore, key string, age time.Duration) {
+	putString(t, store, key, "xfoo", nil)
+
+	dataPath, _, _ := store.paths(key)
+	modified := time.Now().Add(-age)
+	err := os.Chtimes(dataPath, modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectStored(t *testing.T, store CacheStore, key string, stored bool) {
+	object, err := store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (object != nil) != stored {
+		t.Errorf("Expected %s stored=%v", key, stored)
+	}
+}
+
+func TestSweepExpiresUnusedObjects(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	routes := newTestJanitorRoutes(t, &ProxyConfig{
+		Store:       store,
+		Prefix:      "production",
+		ExpireAfter: time.Hour,
+		IndexSize:   10,
+		IndexTTL:    time.Hour,
+	})
+
+	putAged(t, store, "production/old", 2*time.Hour)
+	putAged(t, store, "production/old-but-used", 2*time.Hour)
+	putAged(t, store, "production/recent", time.Minute)
+	putAged(t, store, "other/old", 2*time.Hour)
+
+	routes.accessed.Touch("production/old-but-used")
+	routes.index.Set("production/old", true)
+
+	err := routes.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStored(t, store, "production/old", false)
+	expectStored(t, store, "production/old-but-used", true)
+	expectStored(t, store, "production/recent", true)
+	expectStored(t, store, "other/old", true)
+
+	if _, known := routes.index.Lookup("production/old"); known {
+		t.Fatal("Expected evicted key to be removed from the index")
+	}
+}
+
+func TestSweepMaxStoreSize(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "janitor-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	diskCache, err := NewDiskCache(filepath.Join(dir, "cache"), 1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := newTestJanitorRoutes(t, &ProxyConfig{
+		Store:        store,
+		Prefix:       "production",
+		MaxStoreSize: 8,
+		DiskCache:    diskCache,
+	})
+
+	putAged(t, store, "production/a", 3*time.Hour)
+	putAged(t, store, "production/b", 2*time.Hour)
+	putAged(t, store, "production/c", time.Hour)
+	writeDiskCache(t, diskCache, routes.diskKey("production/a"), "xfoo")
+
+	err = routes.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStored(t, store, "production/a", false)
+	expectStored(t, store, "production/b", true)
+	expectStored(t, store, "production/c", true)
+
+	if _, _, ok := diskCache.Get(routes.diskKey("production/a")); ok {
+		t.Fatal("Expected evicted key to be removed from the disk cache")
+	}
+
+	// Nothing left to do...
+	err = routes.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStored(t, store, "production/b", true)
+}
+
+func TestSweepSkipsObjectsBeingFilled(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	routes := newTestJanitorRoutes(t, &ProxyConfig{
+		Store:       store,
+		ExpireAfter: time.Hour,
+	})
+
+	putAged(t, store, "filling", 2*time.Hour)
+	lock, err := routes.requests.Create("filling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer routes.requests.Complete("filling", lock)
+
+	err = routes.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStored(t, store, "filling", true)
+}
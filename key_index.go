@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// In memory index of which keys exist in the cache bucket so cache hits do not
+// need a HEAD request against s3. Misses are remembered for a (much) shorter
+// period since another proxy may fill the key at any point. Hits are not
+// remembered at all when the positive ttl is zero.
+//
+// All methods are safe to call on a nil index (which never knows anything).
+type keyIndex struct {
+	cache       *ttlCache
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+}
+
+func newKeyIndex(maxEntries int, positiveTTL, negativeTTL time.Duration) *keyIndex {
+	return &keyIndex{
+		cache:       newTTLCache(maxEntries),
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// Returns if the key exists and if the index knows the answer at all.
+func (self *keyIndex) Lookup(key string) (exists bool, known bool) {
+	if self == nil {
+		return false, false
+	}
+
+	value, ok := self.cache.Get(key)
+	if !ok {
+		return false, false
+	}
+	return value.(bool), true
+}
+
+func (self *keyIndex) Set(key string, exists bool) {
+	if self == nil {
+		return
+	}
+
+	if exists {
+		if self.positiveTTL > 0 {
+			self.cache.Set(key, true, self.positiveTTL)
+		}
+	} else if self.negativeTTL > 0 {
+		self.cache.Set(key, false, self.negativeTTL)
+	}
+}
+
+func (self *keyIndex) Remove(key string) {
+	if self == nil {
+		return
+	}
+	self.cache.Remove(key)
+}
+
+// Whether objects may be removed from the store behind the index's back (by
+// the janitor of any proxy sharing the store or by a lifecycle rule).
+func expiresObjects(config *ProxyConfig) bool {
+	return config.ExpireAfter > 0 || config.MaxStoreSize > 0 || config.LifecycleDays > 0
+}
+
+// Key index shared by the routes of a store (nil when disabled). Evictions
+// by other proxies are never seen so hits are not remembered when any of the
+// routes expires objects (a remembered hit would redirect to a deleted
+// object for up to the positive ttl).
+func newStoreKeyIndex(configs []*ProxyConfig) *keyIndex {
+	if len(configs) == 0 || configs[0].IndexSize <= 0 {
+		return nil
+	}
+
+	positiveTTL := configs[0].IndexTTL
+	for _, config := range configs {
+		if expiresObjects(config) {
+			positiveTTL = 0
+		}
+	}
+	return newKeyIndex(configs[0].IndexSize, positiveTTL, configs[0].IndexNegativeTTL)
+}
+
+// Seed the index with the keys already in the store (stops once the index is
+// full).
+func (self *keyIndex) Scan(store CacheStore, prefix string) error {
+	if self == nil || self.positiveTTL <= 0 {
+		return nil
+	}
+
+	startTime := time.Now()
+	err := store.List(prefix, func(object *CacheObject) bool {
+		if self.cache.Len() >= self.cache.maxEntries {
+			log.Printf("Key index full after scanning to %s", object.Key)
+			return false
+		}
+		self.Set(object.Key, true)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf(
+		"Scanned %d keys into index in %v",
+		self.cache.Len(),
+		time.Now().Sub(startTime),
+	)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+	"testing"
+	"time"
+)
+
+func TestKeyIndexScan(t *testing.T) {
+	server, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Quit()
+
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL(),
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{}, region).Bucket("bucket")
+	err = bucket.PutBucket(s3.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"production/a", "production/b", "other/c"} {
+		err = bucket.Put(key, []byte("xfoo"), "text/plain", s3.Private, s3.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := newKeyIndex(10, time.Hour, time.Hour)
+	err = index.Scan(NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE), "production/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, known := index.Lookup("production/b"); !exists || !known {
+		t.Fatal("Expected production/b to be indexed")
+	}
+
+	if _, known := index.Lookup("other/c"); known {
+		t.Fatal("Expected other/c to be outside of the scanned prefix")
+	}
+}
+
+func TestNilKeyIndex(t *testing.T) {
+	var index *keyIndex
+	index.Set("xfoo", true)
+	if _, known := index.Lookup("xfoo"); known {
+		t.Fatal("Nil index should never know about a key")
+	}
+}
+
+func TestStoreKeyIndexForgetsHitsWhenObjectsExpire(t *testing.T) {
+	config := &ProxyConfig{IndexSize: 10, IndexTTL: time.Hour, IndexNegativeTTL: time.Minute}
+	index := newStoreKeyIndex([]*ProxyConfig{config})
+	index.Set("production/a", true)
+	if exists, known := index.Lookup("production/a"); !exists || !known {
+		t.Fatal("Expected hits to be remembered when nothing expires objects")
+	}
+
+	// Any route of the store expiring objects (here or in another proxy)...
+	expiring := *config
+	expiring.LifecycleDays = 7
+	index = newStoreKeyIndex([]*ProxyConfig{config, &expiring})
+	index.Set("production/a", true)
+	if _, known := index.Lookup("production/a"); known {
+		t.Fatal("Expected hits not to be remembered when objects expire")
+	}
+	index.Set("production/b", false)
+	if exists, known := index.Lookup("production/b"); exists || !known {
+		t.Fatal("Expected misses to still be remembered")
+	}
+
+	if newStoreKeyIndex([]*ProxyConfig{{}}) != nil {
+		t.Fatal("Expected no index without an index size")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/goamz/goamz/s3"
+	"net/http"
+	"strings"
+)
+
+// Rules installed by the proxy have ids starting with this (any other rules
+// belong to the bucket owner and are left alone).
+const LIFECYCLE_RULE_ID_PREFIX = "s3-copy-proxy "
+
+// Expire objects under the prefix this many days after they were filled.
+type lifecycleRule struct {
+	Prefix string
+	Days   int
+}
+
+// Rules are kept as raw xml so rules of the bucket owner are put back exactly
+// as they were (whatever they contain).
+type lifecycleConfiguration struct {
+	XMLName xml.Name           `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRuleXML `xml:"Rule"`
+}
+
+type lifecycleRuleXML struct {
+	Inner string `xml:",innerxml"`
+}
+
+func (self lifecycleRuleXML) ID() string {
+	rule := struct {
+		ID string `xml:"ID"`
+	}{}
+	xml.Unmarshal([]byte("<Rule>"+self.Inner+"</Rule>"), &rule)
+	return rule.ID
+}
+
+type proxyLifecycleRuleXML struct {
+	XMLName xml.Name `xml:"Rule"`
+	ID      string   `xml:"ID"`
+	Filter  struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"Filter"`
+	Status     string `xml:"Status"`
+	Expiration struct {
+		Days int `xml:"Days"`
+	} `xml:"Expiration"`
+	AbortIncompleteMultipartUpload struct {
+		DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+	} `xml:"AbortIncompleteMultipartUpload"`
+}
+
+func (self lifecycleRule) XML() (lifecycleRuleXML, error) {
+	rule := proxyLifecycleRuleXML{
+		ID:     LIFECYCLE_RULE_ID_PREFIX + self.Prefix,
+		Status: "Enabled",
+	}
+	rule.Filter.Prefix = self.Prefix
+	rule.Expiration.Days = self.Days
+	// Abandoned multipart uploads are never seen by the janitor...
+	rule.AbortIncompleteMultipartUpload.DaysAfterInitiation = 1
+
+	content, err := xml.Marshal(rule)
+	if err != nil {
+		return lifecycleRuleXML{}, err
+	}
+	// Only the content of the element is kept (the element is added back when
+	// the configuration is marshaled).
+	inner := strings.TrimSuffix(strings.TrimPrefix(string(content), "<Rule>"), "</Rule>")
+	return lifecycleRuleXML{Inner: inner}, nil
+}
+
+// Rules in the bucket's lifecycle configuration (none when it has no
+// configuration).
+func getLifecycleRules(bucket *s3.Bucket) ([]lifecycleRuleXML, error) {
+	req, err := http.NewRequest("GET", bucket.URL("")+"?lifecycle", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doSignedBucketRequest(bucket, req, nil)
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	config := lifecycleConfiguration{}
+	err = xml.NewDecoder(resp.Body).Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse lifecycle configuration of %s: %v", bucket.Name, err)
+	}
+	return config.Rules, nil
+}
+
+// Replace the rules installed by the proxy in the lifecycle configuration of
+// the bucket with the given rules (keeping the rules of the bucket owner).
+//
+// This is done by hand (signed with AWS signature version 4) rather then with
+// `Bucket.PutBucketSubresource` since S3 requires a Content-MD5 header for
+// lifecycle configuration which goamz has no way of sending.
+func putLifecycleRules(bucket *s3.Bucket, rules []lifecycleRule) error {
+	existing, err := getLifecycleRules(bucket)
+	if err != nil {
+		return err
+	}
+
+	config := lifecycleConfiguration{}
+	for _, rule := range existing {
+		if !strings.HasPrefix(rule.ID(), LIFECYCLE_RULE_ID_PREFIX) {
+			config.Rules = append(config.Rules, rule)
+		}
+	}
+	for _, rule := range rules {
+		ruleXML, err := rule.XML()
+		if err != nil {
+			return err
+		}
+		config.Rules = append(config.Rules, ruleXML)
+	}
+
+	// A configuration must have at least one rule...
+	if len(config.Rules) == 0 {
+		if len(existing) == 0 {
+			return nil
+		}
+		req, err := http.NewRequest("DELETE", bucket.URL("")+"?lifecycle", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := doSignedBucketRequest(bucket, req, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	body, err := xml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", bucket.URL("")+"?lifecycle", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	md5Sum := md5.Sum(body)
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+
+	resp, err := doSignedBucketRequest(bucket, req, body)
+	if err != nil {
+		return fmt.Errorf("Cannot put lifecycle rules of %s: %v", bucket.Name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedRequest struct {
+	method string
+	query  string
+	header http.Header
+	body   string
+}
+
+// Bucket of an s3 endpoint which accepts (and records) every request.
+func newRecordingBucket(t *testing.T) (*s3.Bucket, *[]recordedRequest, func()) {
+	requests := []recordedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, recordedRequest{
+			method: req.Method,
+			query:  req.URL.RawQuery,
+			header: req.Header,
+			body:   string(body),
+		})
+	}))
+
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL,
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, region).Bucket("bucket")
+	return bucket, &requests, server.Close
+}
+
+// Fake s3 which keeps the lifecycle configuration of a bucket (which s3test
+// does not) and records the requests made.
+type lifecycleS3 struct {
+	sync.Mutex
+	configuration string
+	requests      []recordedRequest
+}
+
+func (self *lifecycleS3) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	self.requests = append(self.requests, recordedRequest{
+		method: req.Method,
+		query:  req.URL.RawQuery,
+		header: req.Header,
+		body:   string(body),
+	})
+
+	switch req.Method {
+	case "GET":
+		if self.configuration == "" {
+			res.WriteHeader(404)
+			res.Write([]byte("<Error><Code>NoSuchLifecycleConfiguration</Code></Error>"))
+			return
+		}
+		res.Write([]byte(self.configuration))
+	case "PUT":
+		self.configuration = string(body)
+	case "DELETE":
+		self.configuration = ""
+		res.WriteHeader(204)
+	}
+}
+
+// Methods of the requests made so far.
+func (self *lifecycleS3) methods() []string {
+	self.Lock()
+	defer self.Unlock()
+	methods := []string{}
+	for _, req := range self.requests {
+		methods = append(methods, req.method)
+	}
+	return methods
+}
+
+func newLifecycleBucket(t *testing.T, configuration string) (*s3.Bucket, *lifecycleS3, func()) {
+	fake := &lifecycleS3{configuration: configuration}
+	server := httptest.NewServer(fake)
+
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL,
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, region).Bucket("bucket")
+	return bucket, fake, server.Close
+}
+
+const ownerLifecycleRule = "<Rule><ID>owner logs</ID><Filter><Prefix>logs/</Prefix></Filter><Status>Enabled</Status>" +
+	"<Transition><Days>30</Days><StorageClass>GLACIER</StorageClass></Transition></Rule>"
+
+func TestPutLifecycleRules(t *testing.T) {
+	existing := `<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		ownerLifecycleRule +
+		"<Rule><ID>s3-copy-proxy staging/</ID><Filter><Prefix>staging/</Prefix></Filter><Status>Enabled</Status></Rule>" +
+		"</LifecycleConfiguration>"
+	bucket, fake, cleanup := newLifecycleBucket(t, existing)
+	defer cleanup()
+
+	err := putLifecycleRules(bucket, []lifecycleRule{{Prefix: "production/", Days: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if methods := fake.methods(); len(methods) != 2 || methods[0] != "GET" || methods[1] != "PUT" {
+		t.Fatalf("Expected the configuration to be read then written got %v", methods)
+	}
+	req := fake.requests[1]
+	if req.query != "lifecycle" {
+		t.Fatalf("Unexpected request %s ?%s", req.method, req.query)
+	}
+
+	md5Sum := md5.Sum([]byte(req.body))
+	if req.header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+		t.Fatalf("Missing or wrong Content-MD5 %s", req.header.Get("Content-MD5"))
+	}
+	if !strings.HasPrefix(req.header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		t.Fatalf("Expected a version 4 signature got %s", req.header.Get("Authorization"))
+	}
+
+	// The rules of the bucket owner are kept as they were...
+	for _, expected := range []string{ownerLifecycleRule, "<Prefix>production/</Prefix>", "<Days>7</Days>", "<Status>Enabled</Status>"} {
+		if !strings.Contains(req.body, expected) {
+			t.Errorf("Expected %s in %s", expected, req.body)
+		}
+	}
+	// ...but our own old rules are replaced.
+	if strings.Contains(req.body, "staging/") {
+		t.Errorf("Expected the old rule to be replaced in %s", req.body)
+	}
+}
+
+func TestPutLifecycleRulesRemovesOurRules(t *testing.T) {
+	existing := "<LifecycleConfiguration><Rule><ID>s3-copy-proxy staging/</ID><Status>Enabled</Status></Rule></LifecycleConfiguration>"
+	bucket, fake, cleanup := newLifecycleBucket(t, existing)
+	defer cleanup()
+
+	err := putLifecycleRules(bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if methods := fake.methods(); len(methods) != 2 || methods[1] != "DELETE" {
+		t.Fatalf("Expected the configuration to be deleted got %v", methods)
+	}
+
+	// Nothing to do without any configuration...
+	err = putLifecycleRules(bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if methods := fake.methods(); len(methods) != 3 || methods[2] != "GET" {
+		t.Fatalf("Expected the configuration to only be read got %v", methods)
+	}
+}
+
+// Wait (up to a second) for the fake to have seen this many requests.
+func waitForRequests(t *testing.T, fake *lifecycleS3, count int) []string {
+	for i := 0; i < 100; i++ {
+		if methods := fake.methods(); len(methods) >= count {
+			return methods
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d requests got %v", count, fake.methods())
+	return nil
+}
+
+func TestProxyInstallsChangedLifecycleRules(t *testing.T) {
+	bucket, fake, cleanup := newLifecycleBucket(t, "")
+	defer cleanup()
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	routesWithDays := func(days int) []*Routes {
+		config := &ProxyConfig{
+			Store:         NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE),
+			Prefix:        "production",
+			LifecycleDays: days,
+		}
+		metricsFactory := NewMetricFactory(&HostDetails{}, config)
+		routes := NewRoutes(config, newRequestMutex(), newAccessLog(), newStoreKeyIndex([]*ProxyConfig{config}), &Metrics{}, &metricsFactory)
+		return []*Routes{&routes}
+	}
+	update := func(days int) {
+		proxy.Lock()
+		defer proxy.Unlock()
+		proxy.updateLifecycleRules(routesWithDays(days))
+	}
+
+	update(7)
+	waitForRequests(t, fake, 2)
+
+	// Reloading with the same rules leaves the bucket alone...
+	update(7)
+	time.Sleep(50 * time.Millisecond)
+	if methods := fake.methods(); len(methods) != 2 {
+		t.Fatalf("Expected no requests for unchanged rules got %v", methods)
+	}
+
+	update(14)
+	waitForRequests(t, fake, 4)
+	if !strings.Contains(fake.configuration, "<Days>14</Days>") {
+		t.Fatalf("Expected the new rule got %s", fake.configuration)
+	}
+
+	// Rules removed from the config are removed from the bucket...
+	update(0)
+	methods := waitForRequests(t, fake, 6)
+	if methods[5] != "DELETE" {
+		t.Fatalf("Expected our rules to be removed got %v", methods)
+	}
+}
@@ -3,46 +3,163 @@ package main
 import (
 	"fmt"
 	"github.com/goamz/goamz/aws"
-	"github.com/goamz/goamz/s3"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	docopt "github.com/docopt/docopt-go"
 )
 
-func strToRegion(region string) (*aws.Region, error) {
-	switch region {
-	case "us-east-1":
-		return &aws.USEast, nil
-	case "us-west-1":
-		return &aws.USWest, nil
-	case "us-west-2":
-		return &aws.USWest2, nil
-	case "eu-west-1":
-		return &aws.EUWest, nil
-	case "eu-central-1":
-		return &aws.EUCentral, nil
-	case "ap-southeast-1":
-		return &aws.APSoutheast, nil
-	case "ap-southeast-2":
-		return &aws.APSoutheast2, nil
-	case "ap-northeast-1":
-		return &aws.APNortheast, nil
-	case "sa-east-1":
-		return &aws.SAEast, nil
-	case "cn-north-1":
-		return &aws.CNNorth, nil
+// Resolve the region buckets are accessed in. When an endpoint is given (for
+// s3 compatible stores) any region name is accepted and buckets are addressed
+// as subdomains of the endpoint unless pathStyle is set.
+func strToRegion(region, endpoint string, pathStyle bool) (*aws.Region, error) {
+	awsRegion, known := aws.Regions[region]
+	if endpoint == "" {
+		if !known {
+			return nil, fmt.Errorf("Unknown region %s", region)
+		}
+		return &awsRegion, nil
 	}
 
-	return nil, fmt.Errorf("Unknown region %s", region)
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse s3 endpoint: %v", err)
+	}
+	if endpointURL.Scheme == "" || endpointURL.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %s must be an absolute url", endpoint)
+	}
+
+	if !known {
+		awsRegion = aws.Region{
+			Name:                 region,
+			S3LocationConstraint: true,
+		}
+	}
+
+	awsRegion.S3Endpoint = strings.TrimSuffix(endpoint, "/")
+	awsRegion.S3BucketEndpoint = ""
+	if !pathStyle {
+		awsRegion.S3BucketEndpoint = fmt.Sprintf(
+			"%s://${bucket}.%s", endpointURL.Scheme, endpointURL.Host,
+		)
+	}
+
+	return &awsRegion, nil
 }
 
 type ProxyConfig struct {
-	Source *url.URL
-	Bucket *s3.Bucket
+	// Origins to replicate from in order of preference.
+	Sources []*url.URL
+	// When set requests to the sources are signed (for this region) with
+	// SourceAuth so private buckets can be replicated.
+	SourceRegion string
+	SourceAuth   aws.Auth
+	// Where cached objects are kept (usually an S3Store of the regional
+	// bucket).
+	Store  CacheStore
 	Prefix string
+
+	// Custom endpoint of an s3 compatible store (routes which set their own
+	// region and bucket use these too).
+	S3Endpoint  string
+	S3PathStyle bool
+
+	// Objects larger then this many bytes are uploaded (to s3 stores) using
+	// multipart uploads in parts of MultipartPartSize.
+	MultipartThreshold int64
+	MultipartPartSize  int64
+
+	// When true the client which triggers a cache fill is streamed the source
+	// content directly while it is uploaded.
+	Tee bool
+	// Most bytes a tee client may fall behind the source before it is cut off
+	// (so it cannot slow down the fill).
+	TeeMaxClientLag int64
+
+	// When true objects are stored privately and clients are redirected to
+	// signed urls (valid for SignedURLExpiry) of s3 stores.
+	Private         bool
+	SignedURLExpiry time.Duration
+
+	// How objects are stored in s3 stores. ACL overrides the acl implied by
+	// Private when set and SSE is empty (no encryption), AES256 or aws:kms
+	// (with the SSEKMSKeyID key or the account default).
+	StorageClass string
+	ACL          string
+	SSE          string
+	SSEKMSKeyID  string
+	// Extra x-amz-meta-* metadata (by name without the prefix) recorded on
+	// every object.
+	Metadata map[string]string
+	// Source response headers copied onto cached objects (names ending in *
+	// match by prefix).
+	PassthroughHeaders []string
+
+	// Fills are coordinated with other proxies sharing the store (which
+	// must implement FillLocker) using claims leased for FillLockLease
+	// (disabled when zero). Other proxies check on the fill every FillLockPoll.
+	FillLockLease time.Duration
+	FillLockPoll  time.Duration
+
+	// Identifies this proxy to other proxies (fill lock owner, loop
+	// prevention between parents).
+	ProxyID string
+
+	// Proxies asked for objects they already have before the sources.
+	Parents []*url.URL
+
+	// Keys are spread across these proxies (including PeerSelf, our own
+	// url) using a consistent hash ring with PeerVirtualNodes points per
+	// peer. Requests for keys owned by another peer are forwarded to it.
+	Peers            []*url.URL
+	PeerSelf         *url.URL
+	PeerVirtualNodes int
+
+	// Objects not used (served or filled) for ExpireAfter and the least
+	// recently used objects over MaxStoreSize bytes are deleted every
+	// JanitorInterval (both disabled when zero).
+	ExpireAfter     time.Duration
+	MaxStoreSize    int64
+	JanitorInterval time.Duration
+	// Days after which the lifecycle rule installed on s3 stores expires
+	// objects under the prefix (no rule when zero).
+	LifecycleDays int
+
+	// Optional local disk tier consulted before the bucket (may be nil).
+	DiskCache *DiskCache
+
+	// Bounds of the in memory index of keys in the bucket (disabled when
+	// IndexSize is zero).
+	IndexSize        int
+	IndexTTL         time.Duration
+	IndexNegativeTTL time.Duration
+
+	// How long failed (403, 404, 5xx) source responses are remembered for and
+	// if we respond with their status rather then redirecting to the source.
+	NegativeCacheTTL     time.Duration
+	NegativeCacheRespond bool
+
+	// Source bodies without a content length are spooled to disk (up to this
+	// many bytes) before uploading. Zero disables caching of these bodies.
+	MaxSpoolSize int64
+
+	// Cached objects older then this are revalidated against the source
+	// (zero disables revalidation).
+	RevalidateAfter time.Duration
+
+	// Also compute (and verify when the source provides one) the sha256 of
+	// cache fills.
+	VerifySHA256 bool
+
+	// Longest a request will wait on another request's cache fill before being
+	// redirected to the source.
+	MaxSourcePullWait time.Duration
 }
 
 var version = "s3-copy-proxy 1.0"
@@ -57,82 +174,121 @@ region.
 Note it is expected that environment variables will be used to pass AWS credentails...
 
   Usage:
-    proxy --source=<host> --region=<region> --bucket=<name> [--prefix=<path> --port=<port> --metadata-url=<url>]
+    proxy (--source=<host>)... --region=<region> --bucket=<name> [options]
+    proxy (--source=<host>)... --store-dir=<path> [options]
+    proxy --routes=<file> [--source=<host>]... [--region=<region>] [--bucket=<name>] [--store-dir=<path>] [options]
+    proxy --config=<file> [--routes=<file>] [--source=<host>]... [--region=<region>] [--bucket=<name>] [--store-dir=<path>] [options]
     proxy --help
 
   Options:
-    --source=<host>     Where to replicate content from.
+    --source=<host>     Where to replicate content from (repeat for fallback origins tried in order).
     --region=<region>   AWS Region where the bucket resides in.
     --bucket=<name>     Bucket Name.
+    --config=<file>     JSON file of options (reloaded on SIGHUP), see the README.
+    --routes=<file>     JSON routing table of path prefixes and hosts to their own sources and buckets.
+    --source-region=<region>  Sign source requests for this region with our own credentials (for private sources).
+    --s3-endpoint=<url>  Endpoint of an s3 compatible store to use rather then AWS (any region name is accepted).
+    --s3-path-style     Address buckets at --s3-endpoint by path rather then by subdomain.
+    --store-dir=<path>  Cache into this local directory (served by the proxy itself) rather then a bucket.
+    --private           Store objects privately and redirect to signed urls rather then public ones.
+    --signed-url-expiry=<duration>  How long signed urls are valid for (with --private) [default: 1h]
+    --storage-class=<class>  Storage class of cached objects [default: REDUCED_REDUNDANCY]
+    --acl=<acl>         Canned acl of cached objects (defaults to public-read, or private with --private).
+    --sse=<algorithm>   Server side encryption of cached objects (AES256 or aws:kms which requires --private).
+    --sse-kms-key-id=<id>  Kms key of aws:kms encrypted objects (defaults to the account's s3 key).
+    --metadata=<pairs>  Extra metadata for cached objects as comma separated name=value pairs.
+    --passthrough-headers=<names>  Comma separated source headers to keep on cached objects, * matches by prefix (defaults to the content and caching headers plus x-amz-meta-*).
+    --fill-lock-lease=<duration>  Coordinate fills with other proxies sharing the store using locks leased this long (0s disables) [default: 0s]
+    --fill-lock-poll=<duration>  How often to check on fills by other proxies [default: 1s]
+    --proxy-id=<id>     Unique id of this proxy (defaults to the hostname, pid and a random suffix).
+    --parents=<urls>    Comma separated urls of proxies (in other regions) to fill from before the sources when they have the object.
+    --peers=<urls>      Comma separated urls of proxies to spread keys across (forwarding to the owning peer).
+    --peer-self=<url>   Url peers reach this proxy at (required with --peers).
+    --peer-virtual-nodes=<count>  Points on the hash ring per peer [default: 100]
+    --expire-after=<duration>  Delete cached objects not used for this long (0s disables) [default: 0s]
+    --max-store-size=<bytes>  Delete the least recently used cached objects over this many bytes (0 disables) [default: 0]
+    --janitor-interval=<duration>  How often to look for objects to delete [default: 1h]
+    --lifecycle-days=<days>  Install a bucket lifecycle rule expiring cached objects after this many days (0 disables) [default: 0]
     --prefix=<path>     Prefix to use within bucket when replicating. [deafult:]
     --port=<number>     Port to bind to [default: 8080]
-		--metdata-url=<url> Location where to pull metadata for this instance by default assumes aws [deafult:]
+    --shutdown-timeout=<duration>  Longest to wait for requests and fills in progress on SIGTERM [default: 60s]
+    --admin-path=<path>  Path to serve the healthz, readyz and status endpoints under (never routed to a source) [default: /_proxy]
+    --metadata-url=<url> Location where to pull metadata for this instance by default assumes aws [deafult:]
+    --multipart-threshold=<bytes>  Objects larger then this are uploaded in parts [default: 5368709120]
+    --multipart-part-size=<bytes>  Size of each part in a multipart upload [default: 67108864]
+    --tee               Stream the source to the client which triggered the cache fill.
+    --tee-max-client-lag=<bytes>  Most bytes a tee client may fall behind the source (buffered on disk) before it is cut off [default: 1073741824]
+    --disk-cache-dir=<path>  Directory for the local disk cache (disabled when not set).
+    --disk-cache-size=<bytes>  Maximum size of the local disk cache [default: 10737418240]
+    --disk-cache-max-age=<duration>  Maximum age of objects in the local disk cache [default: 24h]
+    --index-size=<entries>  Number of keys to remember in memory (0 disables) [default: 100000]
+    --index-ttl=<duration>  How long to remember a key exists in the bucket [default: 1h]
+    --index-negative-ttl=<duration>  How long to remember a key is missing from the bucket [default: 10s]
+    --negative-cache-ttl=<duration>  How long to remember failed source requests (0s disables) [default: 30s]
+    --negative-cache-respond  Respond with the remembered status rather then redirecting to the source.
+    --max-spool-size=<bytes>  Largest source body without a content length to cache (0 disables) [default: 1073741824]
+    --revalidate-after=<duration>  Revalidate cached objects older then this with the source (0s disables) [default: 0s]
+    --verify-sha256     Verify cache fills against the x-amz-meta-sha256 header of the source.
+    --max-source-pull-wait=<duration>  Longest to wait on another request's cache fill [default: 90s]
+    --influxdb-url=<url>  Where to send metrics (defaults to the INFLUXDB_URL environment variable).
 
   Examples:
     proxy --source=https://s3-us-west-2.amazonaws.com/taskcluster-public-artifacts \
       --region=us-east-1 \
       --bucket=taskcluster-public-artifacts-us-east-1 \
       --prefix=production
+
+    proxy --routes=routes.json --region=us-east-1
 `
 
 func main() {
-	arguments, err := docopt.Parse(usage, nil, true, version, false, true)
-	if err != nil {
-		log.Fatal(err)
-	}
+	argv := os.Args[1:]
+	explicit := explicitOptions(argv)
 
-	// Convert arguments into their appropriate go types...
-	source := arguments["--source"].(string)
-	region := arguments["--region"].(string)
-	bucket := arguments["--bucket"].(string)
+	// Credentials are only read from the environment once something needs
+	// them (so --help or a local store work without any)...
+	var auth *aws.Auth
 
-	port, err := strconv.Atoi(arguments["--port"].(string))
-	if err != nil {
-		log.Fatalf("Cannot parse port into int: %v", err)
-	}
+	// Read the command line (and config file) from scratch each time so a
+	// reload sees exactly what a restart would.
+	loadConfig := func() (*Config, error) {
+		arguments, err := docopt.Parse(usage, argv, true, version, false, true)
+		if err != nil {
+			return nil, err
+		}
 
-	var metadataURL string
-	metadata := arguments["--metadata-url"]
-	if metadata == nil {
-		metadataURL = ""
-	} else {
-		metadataURL = metadata.(string)
-	}
+		if arguments["--config"] != nil {
+			err := applyConfigFile(arguments["--config"].(string), arguments, explicit)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	var prefix string
-	if arguments["--prefix"] == nil {
-		prefix = ""
-	} else {
-		prefix = arguments["--prefix"].(string)
-	}
+		if auth != nil {
+			return ParseConfig(arguments, *auth)
+		}
 
-	url, err := url.Parse(source)
-	if err != nil {
-		log.Fatalf("Error parsing source into url : %v", err)
-	}
+		config, err := ParseConfig(arguments, aws.Auth{})
+		if err != nil || !config.NeedsAWSAuth() {
+			return config, err
+		}
 
-	awsRegionObj, err := strToRegion(region)
-	if err != nil {
-		log.Fatal(err)
+		envAuth, err := aws.EnvAuth()
+		if err != nil {
+			return nil, err
+		}
+		auth = &envAuth
+		return ParseConfig(arguments, *auth)
 	}
 
-	auth, err := aws.EnvAuth()
+	config, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client := s3.New(auth, *awsRegionObj)
-	s3Bucket := client.Bucket(bucket)
+	log.Printf("Proxy server starting on port %d", config.Port)
 
-	config := ProxyConfig{
-		Source: url,
-		Bucket: s3Bucket,
-		Prefix: prefix,
-	}
-
-	log.Printf("Proxy server starting on port %d", port)
-
-	hostType := GetHostType(metadataURL)
+	hostType := GetHostType(config.MetadataURL)
 	hostDetails, err := hostType.Details()
 	if err != nil {
 		log.Fatal(err)
@@ -149,16 +305,59 @@ func main() {
 		hostDetails.InstanceType,
 	)
 
-	metrics, err := NewMetrics()
+	var metrics *Metrics
+	if config.InfluxDBURL != "" {
+		metrics, err = NewMetricsFromURL(config.InfluxDBURL)
+	} else {
+		metrics, err = NewMetrics()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxy := NewProxy(metrics, hostDetails)
+	err = proxy.Load(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	metricsFactory := NewMetricFactory(hostDetails, &config)
+	// Reload the configuration on SIGHUP (keeping the running config on any
+	// error)...
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			log.Printf("Reloading configuration")
+			config, err := loadConfig()
+			if err == nil {
+				err = proxy.Load(config)
+			}
+			if err != nil {
+				log.Printf("Error reloading configuration (keeping the old one) %v", err)
+			}
+		}
+	}()
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: proxy,
+	}
+
+	// Drain everything in progress on SIGTERM (or ^C) before exiting...
+	stopped := make(chan bool)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-terminate
+		log.Printf("Shutting down")
+		proxy.Shutdown(server)
+		close(stopped)
+	}()
 
-	routes := NewRoutes(&config, metrics, &metricsFactory)
-	startErr := http.ListenAndServe(fmt.Sprintf(":%d", port), routes)
-	if startErr != nil {
+	startErr := server.ListenAndServe()
+	if startErr != http.ErrServerClosed {
 		log.Fatal(startErr)
 	}
+	<-stopped
+	log.Printf("Shutdown complete")
 }
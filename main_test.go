@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+	"testing"
+)
+
+func TestStrToRegion(t *testing.T) {
+	region, err := strToRegion("us-gov-west-1", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region.S3Endpoint != aws.USGovWest.S3Endpoint {
+		t.Fatalf("Unexpected endpoint %s", region.S3Endpoint)
+	}
+
+	_, err = strToRegion("mars-north-1", "", false)
+	if err == nil {
+		t.Fatal("Expected error for unknown region")
+	}
+
+	region, err = strToRegion("mars-north-1", "https://s3.example.com/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := s3.New(aws.Auth{}, *region).Bucket("bucket").URL("key")
+	if url != "https://bucket.s3.example.com/key" {
+		t.Fatalf("Unexpected subdomain url %s", url)
+	}
+
+	_, err = strToRegion("us-east-1", "s3.example.com", false)
+	if err == nil {
+		t.Fatal("Expected error for relative endpoint")
+	}
+}
+
+func TestStrToRegionPathStyleEndpoint(t *testing.T) {
+	server, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Quit()
+
+	region, err := strToRegion("local", server.URL(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := s3.New(aws.Auth{}, *region).Bucket("bucket")
+	if url := bucket.URL("key"); url != server.URL()+"/bucket/key" {
+		t.Fatalf("Unexpected path style url %s", url)
+	}
+
+	err = bucket.PutBucket(s3.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bucket.Put("key", []byte("xfoo"), "text/plain", s3.Private, s3.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := bucket.Exists("key")
+	if err != nil || !exists {
+		t.Fatalf("Expected key in bucket %v", err)
+	}
+}
@@ -7,12 +7,18 @@ import (
 
 const (
 	CACHE_HIT_SERIES             = "CacheHit"
+	DISK_CACHE_HIT_SERIES        = "DiskCacheHit"
 	CACHE_WAITED_FOR_UPLOAD      = "CacheWaitedForUpload"
 	CACHE_WAITED_FOR_UPLOAD_MISS = "CacheWaitedForUploadMiss"
 	CACHE_UPLOAD                 = "CacheUpload"
 	CACHE_UPLOAD_ERR             = "CacheUploadError"
 	CACHE_TIMEOUT                = "CacheTimeout"
 	CACHE_ERR_REDIRECT           = "CacheErrorRedirect"
+	NEGATIVE_CACHE_HIT           = "NegativeCacheHit"
+	CACHE_REVALIDATE             = "CacheRevalidate"
+	CACHE_VERIFY_ERR             = "CacheVerifyError"
+	SOURCE_ERR                   = "SourceError"
+	CACHE_EVICT                  = "CacheEvict"
 )
 
 type MetricFactory struct {
@@ -69,7 +75,7 @@ func (self *MetricFactory) CacheTimeout(waitDuration time.Duration) *influxdb.Se
 	}
 }
 
-func (self *MetricFactory) CacheUpload(uploadDuration time.Duration, contentLength int64) *influxdb.Series {
+func (self *MetricFactory) CacheUpload(uploadDuration time.Duration, contentLength int64, origin string) *influxdb.Series {
 	return &influxdb.Series{
 		Name: CACHE_UPLOAD,
 		Columns: []string{
@@ -79,6 +85,7 @@ func (self *MetricFactory) CacheUpload(uploadDuration time.Duration, contentLeng
 			"instanceID",
 			"uploadDuration",
 			"contentLength",
+			"origin",
 		},
 		Points: [][]interface{}{
 			{
@@ -88,12 +95,13 @@ func (self *MetricFactory) CacheUpload(uploadDuration time.Duration, contentLeng
 				self.hostDetails.InstanceID,
 				uploadDuration.Seconds(),
 				contentLength,
+				origin,
 			},
 		},
 	}
 }
 
-func (self *MetricFactory) CacheUploadError(uploadDuration time.Duration, path string, contentLength int64, err error) *influxdb.Series {
+func (self *MetricFactory) CacheUploadError(uploadDuration time.Duration, path string, contentLength int64, origin string, err error) *influxdb.Series {
 	return &influxdb.Series{
 		Name: CACHE_UPLOAD_ERR,
 		Columns: []string{
@@ -104,6 +112,7 @@ func (self *MetricFactory) CacheUploadError(uploadDuration time.Duration, path s
 			"uploadDuration",
 			"contentLength",
 			"path",
+			"origin",
 			"error",
 		},
 		Points: [][]interface{}{
@@ -115,6 +124,7 @@ func (self *MetricFactory) CacheUploadError(uploadDuration time.Duration, path s
 				uploadDuration.Seconds(),
 				contentLength,
 				path,
+				origin,
 				err.Error(),
 			},
 		},
@@ -184,3 +194,141 @@ func (self *MetricFactory) CacheHit() *influxdb.Series {
 		},
 	}
 }
+
+func (self *MetricFactory) DiskCacheHit() *influxdb.Series {
+	return &influxdb.Series{
+		Name: DISK_CACHE_HIT_SERIES,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+			},
+		},
+	}
+}
+
+func (self *MetricFactory) NegativeCacheHit(status int) *influxdb.Series {
+	return &influxdb.Series{
+		Name: NEGATIVE_CACHE_HIT,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+			"status",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+				status,
+			},
+		},
+	}
+}
+
+func (self *MetricFactory) CacheRevalidate(age time.Duration, changed bool) *influxdb.Series {
+	return &influxdb.Series{
+		Name: CACHE_REVALIDATE,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+			"age",
+			"changed",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+				age.Seconds(),
+				changed,
+			},
+		},
+	}
+}
+
+func (self *MetricFactory) CacheVerifyError(path string, err error) *influxdb.Series {
+	return &influxdb.Series{
+		Name: CACHE_VERIFY_ERR,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+			"path",
+			"error",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+				path,
+				err.Error(),
+			},
+		},
+	}
+}
+
+func (self *MetricFactory) SourceError(origin string, reason string) *influxdb.Series {
+	return &influxdb.Series{
+		Name: SOURCE_ERR,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+			"origin",
+			"error",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+				origin,
+				reason,
+			},
+		},
+	}
+}
+
+func (self *MetricFactory) CacheEvict(count int, size int64) *influxdb.Series {
+	return &influxdb.Series{
+		Name: CACHE_EVICT,
+		Columns: []string{
+			"hostname",
+			"region",
+			"instanceType",
+			"instanceID",
+			"count",
+			"size",
+		},
+		Points: [][]interface{}{
+			{
+				self.hostDetails.Hostname,
+				self.hostDetails.Region,
+				self.hostDetails.InstanceType,
+				self.hostDetails.InstanceID,
+				count,
+				size,
+			},
+		},
+	}
+}
@@ -65,7 +65,7 @@ func (self *Metrics) periodicSender(ticker *time.Ticker) {
 			go func() {
 				err := self.SendMetrics()
 				if err != nil {
-					log.Printf("Non fatal error while sending metrics", err)
+					log.Printf("Non fatal error while sending metrics %v", err)
 				}
 			}()
 		}
@@ -95,11 +95,16 @@ func (self *Metrics) SendMetrics() error {
 // set this will log warning (but not panic) if there are errors sending the
 // metrics.
 func NewMetrics() (*Metrics, error) {
+	return NewMetricsFromURL(os.Getenv("INFLUXDB_URL"))
+}
+
+// Same as NewMetrics but for an explicit connection string (empty disables
+// sending metrics).
+func NewMetricsFromURL(connectionString string) (*Metrics, error) {
 	pendingWrites := []*influxdb.Series{}
 
-	connectionString := os.Getenv("INFLUXDB_URL")
 	if connectionString == "" {
-		log.Printf("INFLUXDB_URL environment variable empty no metrics will be sent")
+		log.Printf("No influxdb url configured no metrics will be sent")
 		result := &Metrics{
 			Active:        false,
 			pendingWrites: pendingWrites,
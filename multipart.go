@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/goamz/goamz/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// S3 will not accept parts smaller then this (aside from the last one).
+const MIN_MULTIPART_PART_SIZE = 5 * 1024 * 1024
+
+// Largest object S3 will accept in a single PUT.
+const MAX_SINGLE_PUT_SIZE = 5 * 1024 * 1024 * 1024
+
+// Multipart uploads in progress (by key) so they can be aborted on shutdown.
+var activeMultipartUploads = &multipartUploads{uploads: make(map[multipartUpload]string)}
+
+type multipartUploads struct {
+	sync.Mutex
+	uploads map[multipartUpload]string
+}
+
+func (self *multipartUploads) Add(key string, multi multipartUpload) {
+	self.Lock()
+	defer self.Unlock()
+	self.uploads[multi] = key
+}
+
+func (self *multipartUploads) Remove(multi multipartUpload) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.uploads, multi)
+}
+
+// Abort every upload in progress (their fills then fail on the next part).
+// Returns the number of uploads aborted.
+func (self *multipartUploads) AbortAll() int {
+	self.Lock()
+	uploads := map[multipartUpload]string{}
+	for multi, key := range self.uploads {
+		uploads[multi] = key
+	}
+	self.Unlock()
+
+	for multi, key := range uploads {
+		err := multi.Abort()
+		if err != nil {
+			log.Printf("Failed to abort multipart upload of %s: %v", key, err)
+		}
+	}
+	return len(uploads)
+}
+
+// Subset of `s3.Multi` used to upload the parts (makes testing easier).
+type partUploader interface {
+	PutPart(n int, r io.ReadSeeker) (s3.Part, error)
+}
+
+// Multipart upload in progress (an `s3.Multi` or a signedMulti).
+type multipartUpload interface {
+	partUploader
+	Complete(parts []s3.Part) error
+	Abort() error
+}
+
+// Multipart upload whose requests are signed with signature version 4 (which
+// S3 requires for kms encrypted objects) rather then by goamz.
+type signedMulti struct {
+	*s3.Multi
+}
+
+func (self *signedMulti) url(query url.Values) string {
+	query.Set("uploadId", self.UploadId)
+	return self.Bucket.URL(self.Key) + "?" + query.Encode()
+}
+
+// Parts are in memory so they are hashed (and sent) as they are.
+func (self *signedMulti) PutPart(n int, r io.ReadSeeker) (s3.Part, error) {
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), r)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return s3.Part{}, err
+	}
+
+	req, err := http.NewRequest("PUT", self.url(url.Values{"partNumber": {strconv.Itoa(n)}}), ioutil.NopCloser(r))
+	if err != nil {
+		return s3.Part{}, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)))
+
+	resp, err := doBucketRequest(self.Bucket, req, hex.EncodeToString(sha256Hash.Sum(nil)))
+	if err != nil {
+		return s3.Part{}, err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return s3.Part{}, fmt.Errorf("No etag uploading part %d of %s", n, self.Key)
+	}
+	return s3.Part{N: n, ETag: etag, Size: size}, nil
+}
+
+type completeMultipartPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name                `xml:"CompleteMultipartUpload"`
+	Parts   []completeMultipartPart `xml:"Part"`
+}
+
+func (self *signedMulti) Complete(parts []s3.Part) error {
+	complete := completeMultipartUpload{}
+	for _, part := range parts {
+		complete.Parts = append(complete.Parts, completeMultipartPart{PartNumber: part.N, ETag: part.ETag})
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", self.url(url.Values{}), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := doSignedBucketRequest(self.Bucket, req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Failures after the upload started are reported in the body of a 200...
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		s3Err := &s3.Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(result, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+func (self *signedMulti) Abort() error {
+	req, err := http.NewRequest("DELETE", self.url(url.Values{}), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doSignedBucketRequest(self.Bucket, req, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Read the body in chunks of partSize and upload each chunk as a part. Only one
+// part is held in memory at a time so the cost of a fill is bound by partSize.
+func putParts(multi partUploader, body io.Reader, partSize int64) ([]s3.Part, int64, error) {
+	buf := make([]byte, partSize)
+	parts := []s3.Part{}
+	var total int64
+
+	for n := 1; ; n++ {
+		read, err := io.ReadFull(body, buf)
+		// S3 requires at least one part so an empty body still sends an empty
+		// part.
+		if err == io.EOF && n > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, total, err
+		}
+
+		part, putErr := multi.PutPart(n, bytes.NewReader(buf[:read]))
+		if putErr != nil {
+			return nil, total, putErr
+		}
+		parts = append(parts, part)
+		total += int64(read)
+
+		// A short read means we have reached the end of the body.
+		if err != nil {
+			break
+		}
+	}
+
+	return parts, total, nil
+}
+
+// Headers which describe the body of a single request rather then the object
+// (so they are not sent when starting a multipart upload).
+var multipartRequestHeaders = map[string]bool{
+	"Content-Length": true,
+	"Content-Md5":    true,
+}
+
+// Start a multipart upload of the key with all of the headers (and metadata)
+// of the object. `Bucket.InitMulti` only sends the content type and acl which
+// would leave large objects without their encoding, storage options and
+// source validators.
+func initMulti(bucket *s3.Bucket, key string, header http.Header, perm s3.ACL) (*s3.Multi, error) {
+	req, err := http.NewRequest("POST", bucket.URL(key)+"?uploads", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if !multipartRequestHeaders[name] {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("X-Amz-Acl", string(perm))
+
+	resp, err := doSignedBucketRequest(bucket, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		UploadId string `xml:"UploadId"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if result.UploadId == "" {
+		return nil, fmt.Errorf("No upload id starting multipart upload of %s", key)
+	}
+
+	return &s3.Multi{Bucket: bucket, Key: key, UploadId: result.UploadId}, nil
+}
+
+// Upload the body into the bucket using a multipart upload. The upload is
+// aborted on any failure so we don't leave orphaned parts in the bucket (which
+// are billed for but never visible).
+func putMultipart(
+	bucket *s3.Bucket,
+	key string,
+	body io.Reader,
+	contentLength int64,
+	partSize int64,
+	header http.Header,
+	perm s3.ACL,
+	signatureV4 bool,
+) error {
+	started, err := initMulti(bucket, key, header, perm)
+	if err != nil {
+		return err
+	}
+
+	var multi multipartUpload = started
+	if signatureV4 {
+		multi = &signedMulti{started}
+	}
+	activeMultipartUploads.Add(key, multi)
+	defer activeMultipartUploads.Remove(multi)
+
+	parts, total, err := putParts(multi, body, partSize)
+	if err == nil && total != contentLength {
+		err = fmt.Errorf(
+			"Source body for %s was truncated (%d of %d bytes)",
+			key, total, contentLength,
+		)
+	}
+
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+
+	if err != nil {
+		abortErr := multi.Abort()
+		if abortErr != nil {
+			log.Printf("Failed to abort multipart upload of %s: %v", key, abortErr)
+		}
+		return err
+	}
+
+	log.Printf("Completed multipart upload of %s in %d parts", key, len(parts))
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeUploader struct {
+	sizes []int
+}
+
+func (self *fakeUploader) PutPart(n int, r io.ReadSeeker) (s3.Part, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	self.sizes = append(self.sizes, len(content))
+	return s3.Part{N: n, Size: int64(len(content))}, nil
+}
+
+func TestPutPartsSplitsBody(t *testing.T) {
+	uploader := &fakeUploader{}
+	body := bytes.NewReader(make([]byte, 25))
+
+	parts, total, err := putParts(uploader, body, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 25 {
+		t.Fatalf("Unexpected total %d", total)
+	}
+
+	if len(parts) != 3 || parts[2].N != 3 {
+		t.Fatalf("Unexpected parts %v", parts)
+	}
+
+	if uploader.sizes[0] != 10 || uploader.sizes[1] != 10 || uploader.sizes[2] != 5 {
+		t.Fatalf("Unexpected part sizes %v", uploader.sizes)
+	}
+}
+
+func TestPutPartsEmptyBody(t *testing.T) {
+	uploader := &fakeUploader{}
+
+	parts, total, err := putParts(uploader, bytes.NewReader([]byte{}), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 0 || len(parts) != 1 {
+		t.Fatalf("Expected a single empty part got %v", parts)
+	}
+}
+
+// Fake s3 which only knows about uploads (s3test does not do multipart).
+type multipartS3 struct {
+	sync.Mutex
+	// Headers each upload was started with.
+	initiated []http.Header
+	parts     map[string]int
+	completed int
+	aborted   int
+	// Headers of single puts and parts, and the body completing uploads.
+	puts           []http.Header
+	partHeaders    []http.Header
+	completeBodies []string
+}
+
+func (self *multipartS3) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+
+	query := req.URL.Query()
+	switch {
+	case req.Method == "POST" && query.Get("uploads") == "" && strings.HasSuffix(req.URL.RawQuery, "uploads"):
+		self.initiated = append(self.initiated, req.Header)
+		fmt.Fprintf(res, "<InitiateMultipartUploadResult><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>", len(self.initiated))
+	case req.Method == "PUT" && query.Get("uploadId") != "":
+		self.parts[query.Get("uploadId")]++
+		self.partHeaders = append(self.partHeaders, req.Header)
+		res.Header().Set("ETag", `"`+query.Get("partNumber")+`"`)
+	case req.Method == "POST" && query.Get("uploadId") != "":
+		self.completed++
+		self.completeBodies = append(self.completeBodies, string(body))
+		res.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case req.Method == "DELETE" && query.Get("uploadId") != "":
+		self.aborted++
+		res.WriteHeader(204)
+	case req.Method == "PUT":
+		self.puts = append(self.puts, req.Header)
+	default:
+		res.WriteHeader(400)
+	}
+}
+
+func newMultipartBucket(fake *multipartS3) (*s3.Bucket, func()) {
+	server := httptest.NewServer(fake)
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL,
+		S3LocationConstraint: true,
+	}
+	return s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, region).Bucket("bucket"), server.Close
+}
+
+func TestS3StorePutMultipartKeepsHeaders(t *testing.T) {
+	fake := &multipartS3{parts: map[string]int{}}
+	bucket, closeBucket := newMultipartBucket(fake)
+	defer closeBucket()
+	store := NewS3Store(bucket, 4, 4)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-MD5", "ignored")
+	header.Set("x-amz-storage-class", "REDUCED_REDUNDANCY")
+	header.Set(SOURCE_ETAG_META, `"etag"`)
+
+	body := "gzipped body"
+	err := store.Put("production/large", strings.NewReader(body), int64(len(body)), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.initiated) != 1 || fake.parts["upload-1"] != 3 || fake.completed != 1 {
+		t.Fatalf("Unexpected uploads %v %v %d", fake.initiated, fake.parts, fake.completed)
+	}
+
+	initiated := fake.initiated[0]
+	for name, expected := range map[string]string{
+		"Content-Type":           "application/json",
+		"Content-Encoding":       "gzip",
+		"X-Amz-Storage-Class":    "REDUCED_REDUNDANCY",
+		"X-Amz-Meta-Source-Etag": `"etag"`,
+		"X-Amz-Acl":              "public-read",
+	} {
+		if got := initiated.Get(name); got != expected {
+			t.Fatalf("Expected %s of %s got %s", name, expected, got)
+		}
+	}
+	if initiated.Get("Content-MD5") != "" {
+		t.Fatal("Expected the Content-MD5 of the object not to be sent starting the upload")
+	}
+	if !strings.HasPrefix(initiated.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		t.Fatalf("Expected a signed request got %s", initiated.Get("Authorization"))
+	}
+}
+
+func kmsStore(bucket *s3.Bucket) *S3Store {
+	return configuredS3Store(bucket, &ProxyConfig{
+		MultipartThreshold: 4,
+		MultipartPartSize:  4,
+		Private:            true,
+		SignedURLExpiry:    time.Hour,
+		SSE:                SSE_KMS,
+	})
+}
+
+func expectSignatureV4(t *testing.T, header http.Header, payloadHash string) {
+	if !strings.HasPrefix(header.Get("Authorization"), SIGV4_ALGORITHM+" ") {
+		t.Fatalf("Expected a signature version 4 request got %s", header.Get("Authorization"))
+	}
+	if payloadHash != "" && header.Get("X-Amz-Content-Sha256") != payloadHash {
+		t.Fatalf("Expected payload hash %s got %s", payloadHash, header.Get("X-Amz-Content-Sha256"))
+	}
+}
+
+func TestS3StoreKMSPutsWithSignatureV4(t *testing.T) {
+	fake := &multipartS3{parts: map[string]int{}}
+	bucket, closeBucket := newMultipartBucket(fake)
+	defer closeBucket()
+	store := kmsStore(bucket)
+
+	header := objectHeaders(&ProxyConfig{SSE: SSE_KMS, SSEKMSKeyID: "alias/cache"}, "https://source/small", http.Header{})
+	err := store.Put("production/small", strings.NewReader("abc"), 3, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.puts) != 1 {
+		t.Fatalf("Expected a single put got %d", len(fake.puts))
+	}
+	put := fake.puts[0]
+	expectSignatureV4(t, put, UNSIGNED_PAYLOAD)
+	for name, expected := range map[string]string{
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/cache",
+		"X-Amz-Acl":         "private",
+		"X-Amz-Meta-Source": "https://source/small",
+	} {
+		if got := put.Get(name); got != expected {
+			t.Fatalf("Expected %s of %s got %s", name, expected, got)
+		}
+	}
+}
+
+func TestS3StoreKMSPutsMultipartWithSignatureV4(t *testing.T) {
+	fake := &multipartS3{parts: map[string]int{}}
+	bucket, closeBucket := newMultipartBucket(fake)
+	defer closeBucket()
+	store := kmsStore(bucket)
+
+	header := http.Header{}
+	header.Set("x-amz-server-side-encryption", SSE_KMS)
+	err := store.Put("production/large", strings.NewReader("large body"), 10, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.parts["upload-1"] != 3 || fake.completed != 1 {
+		t.Fatalf("Unexpected upload %v %d", fake.parts, fake.completed)
+	}
+	expectSignatureV4(t, fake.initiated[0], "")
+	if fake.initiated[0].Get("X-Amz-Server-Side-Encryption") != SSE_KMS {
+		t.Fatalf("Expected the upload to be started with kms got %v", fake.initiated[0])
+	}
+
+	// Parts are in memory so they are signed with their hash...
+	partHash := sha256.Sum256([]byte("larg"))
+	expectSignatureV4(t, fake.partHeaders[0], hex.EncodeToString(partHash[:]))
+	for _, partHeader := range fake.partHeaders {
+		expectSignatureV4(t, partHeader, "")
+		if partHeader.Get("Content-MD5") == "" {
+			t.Fatal("Expected parts to be sent with their md5")
+		}
+	}
+
+	expected := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"1"</ETag></Part>`
+	if !strings.HasPrefix(strings.Replace(fake.completeBodies[0], "&#34;", `"`, -1), expected) {
+		t.Fatalf("Unexpected complete body %s", fake.completeBodies[0])
+	}
+}
+
+func TestS3StoreKMSAbortsWithSignatureV4(t *testing.T) {
+	fake := &multipartS3{parts: map[string]int{}}
+	bucket, closeBucket := newMultipartBucket(fake)
+	defer closeBucket()
+
+	multi, err := initMulti(bucket, "production/aborted", http.Header{}, s3.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&signedMulti{multi}).Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.aborted != 1 {
+		t.Fatalf("Expected the upload to be aborted got %d", fake.aborted)
+	}
+}
+
+func TestS3StoreKMSRedirectsToPresignedURL(t *testing.T) {
+	fake := &multipartS3{parts: map[string]int{}}
+	bucket, closeBucket := newMultipartBucket(fake)
+	defer closeBucket()
+	store := kmsStore(bucket)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/production/hit", nil)
+	store.Serve("production/hit", res, req)
+
+	if res.Code != 302 {
+		t.Fatalf("Expected a redirect got %d", res.Code)
+	}
+	location, err := url.Parse(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("X-Amz-Algorithm") != SIGV4_ALGORITHM || query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "3600" {
+		t.Fatalf("Expected a signature version 4 url got %s", location)
+	}
+}
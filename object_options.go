@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Metadata recorded on every cached object.
+const (
+	FILL_TIME_META     = "x-amz-meta-fill-time"
+	PROXY_VERSION_META = "x-amz-meta-proxy-version"
+)
+
+// Server side encryption algorithms.
+const (
+	SSE_S3 = "AES256"
+	// Uploaded (and redirected to) with signature version 4 since AWS refuses
+	// kms requests signed any other way.
+	SSE_KMS = "aws:kms"
+)
+
+// Canned acls which may be used for cached objects.
+var validACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// Storage classes which may be used for cached objects (archive classes are
+// left out since objects in them cannot be redirected to).
+var validStorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+}
+
+// Source headers copied onto cached objects by default. Names ending in *
+// match any header with that prefix.
+var defaultPassthroughHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Cache-Control",
+	"Expires",
+	"Content-Language",
+	"x-amz-meta-*",
+}
+
+var metadataNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// Parse extra metadata given as comma separated name=value pairs.
+func parseMetadata(value string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if value == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Metadata %s must be of the form name=value", pair)
+		}
+		metadata[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return metadata, nil
+}
+
+// Parse a comma separated list (of header names, urls, ...).
+func parseList(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Headers of the source response allowed through by the list of names.
+func passthroughHeaders(names []string, sourceHeader http.Header) http.Header {
+	headers := http.Header{}
+	for name, values := range sourceHeader {
+		name = http.CanonicalHeaderKey(name)
+		for _, allowed := range names {
+			allowed = http.CanonicalHeaderKey(allowed)
+			if name == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, allowed[:len(allowed)-1])) {
+				headers[name] = values
+				break
+			}
+		}
+	}
+	return headers
+}
+
+// Check the options used when storing objects make sense.
+func validateObjectOptions(config *ProxyConfig) error {
+	if config.StorageClass != "" && !validStorageClasses[config.StorageClass] {
+		return fmt.Errorf("Unknown storage class %s", config.StorageClass)
+	}
+
+	if config.ACL != "" && !validACLs[config.ACL] {
+		return fmt.Errorf("Unknown acl %s", config.ACL)
+	}
+
+	switch config.SSE {
+	case "", SSE_S3:
+	case SSE_KMS:
+		// Anonymous reads of kms encrypted objects are refused so clients
+		// must be redirected to signed urls...
+		if !config.Private {
+			return fmt.Errorf("Server side encryption %s requires private objects", SSE_KMS)
+		}
+		if config.SignedURLExpiry > MAX_PRESIGNED_URL_EXPIRY {
+			return fmt.Errorf("Signed url expiry cannot exceed %v with server side encryption %s", MAX_PRESIGNED_URL_EXPIRY, SSE_KMS)
+		}
+	default:
+		return fmt.Errorf("Unknown server side encryption %s", config.SSE)
+	}
+
+	if config.SSEKMSKeyID != "" && config.SSE != SSE_KMS {
+		return fmt.Errorf("A kms key id requires server side encryption %s", SSE_KMS)
+	}
+
+	for name := range config.Metadata {
+		if !metadataNamePattern.MatchString(name) {
+			return fmt.Errorf("Invalid metadata name %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Headers for storing an object filled from the given source response.
+func objectHeaders(config *ProxyConfig, sourceURL string, sourceHeader http.Header) http.Header {
+	// Everything the source sent which clients should see from the cache too
+	// (Content Type is important to proxy...)
+	headers := passthroughHeaders(config.PassthroughHeaders, sourceHeader)
+
+	if config.StorageClass != "" {
+		headers.Set("x-amz-storage-class", config.StorageClass)
+	}
+
+	if config.SSE != "" {
+		headers.Set("x-amz-server-side-encryption", config.SSE)
+	}
+	if config.SSEKMSKeyID != "" {
+		headers.Set("x-amz-server-side-encryption-aws-kms-key-id", config.SSEKMSKeyID)
+	}
+
+	for name, value := range config.Metadata {
+		headers.Set("x-amz-meta-"+name, value)
+	}
+
+	// Objects filled from a parent proxy keep the source and validators it
+	// recorded (rather then those of the parent's copy).
+	etag := sourceHeader.Get("ETag")
+	lastModified := sourceHeader.Get("Last-Modified")
+	if fromParent(config, sourceURL) {
+		if recorded := sourceHeader.Get("x-amz-meta-source"); recorded != "" {
+			sourceURL = recorded
+		}
+		etag = sourceHeader.Get(SOURCE_ETAG_META)
+		lastModified = sourceHeader.Get(SOURCE_LAST_MODIFIED_META)
+	}
+
+	// Extra meta data about where/how this objects exists (this wins over
+	// any configured or source metadata of the same name).
+	headers.Set("x-amz-meta-source", sourceURL)
+	headers.Set(FILL_TIME_META, time.Now().UTC().Format(time.RFC3339))
+	headers.Set(PROXY_VERSION_META, version)
+
+	// Validators used to check if the source has changed later on...
+	headers.Del(SOURCE_ETAG_META)
+	if etag != "" {
+		headers.Set(SOURCE_ETAG_META, etag)
+	}
+	headers.Del(SOURCE_LAST_MODIFIED_META)
+	if lastModified != "" {
+		headers.Set(SOURCE_LAST_MODIFIED_META, lastModified)
+	}
+
+	return headers
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseMetadata(t *testing.T) {
+	metadata, err := parseMetadata("team=releng, env=production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 2 || metadata["team"] != "releng" || metadata["env"] != "production" {
+		t.Fatalf("Unexpected metadata %v", metadata)
+	}
+
+	_, err = parseMetadata("team")
+	if err == nil {
+		t.Fatal("Expected metadata without a value to be rejected")
+	}
+}
+
+func TestValidateObjectOptions(t *testing.T) {
+	invalid := []ProxyConfig{
+		{StorageClass: "GLACIER"},
+		{ACL: "everyone"},
+		{SSE: "rot13"},
+		{SSE: SSE_KMS},
+		{SSE: SSE_KMS, Private: true, SignedURLExpiry: 8 * 24 * time.Hour},
+		{SSE: SSE_S3, SSEKMSKeyID: "alias/cache"},
+		{Metadata: map[string]string{"Not Valid": "x"}},
+	}
+	for _, config := range invalid {
+		if validateObjectOptions(&config) == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+
+	valid := ProxyConfig{
+		StorageClass: "STANDARD_IA",
+		ACL:          "bucket-owner-full-control",
+		SSE:          SSE_S3,
+		Metadata:     map[string]string{"team": "releng"},
+	}
+	err := validateObjectOptions(&valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kms := ProxyConfig{
+		Private:         true,
+		SignedURLExpiry: time.Hour,
+		SSE:             SSE_KMS,
+		SSEKMSKeyID:     "alias/cache",
+	}
+	err = validateObjectOptions(&kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectHeaders(t *testing.T) {
+	config := &ProxyConfig{
+		PassthroughHeaders: defaultPassthroughHeaders,
+		StorageClass:       "STANDARD",
+		SSE:                SSE_S3,
+		Metadata:           map[string]string{"team": "releng", "source": "overridden"},
+	}
+	sourceHeader := http.Header{}
+	sourceHeader.Set("Content-Type", "text/plain")
+	sourceHeader.Set("ETag", `"etag"`)
+
+	headers := objectHeaders(config, "https://source/xfoo", sourceHeader)
+
+	expected := map[string]string{
+		"Content-Type":                 "text/plain",
+		"x-amz-storage-class":          "STANDARD",
+		"x-amz-server-side-encryption": SSE_S3,
+		"x-amz-meta-team":              "releng",
+		"x-amz-meta-source":            "https://source/xfoo",
+		SOURCE_ETAG_META:               `"etag"`,
+		PROXY_VERSION_META:             version,
+	}
+	for name, value := range expected {
+		if got := headers.Get(name); got != value {
+			t.Errorf("Expected %s to be %s got %s", name, value, got)
+		}
+	}
+
+	fillTime, err := time.Parse(time.RFC3339, headers.Get(FILL_TIME_META))
+	if err != nil || time.Since(fillTime) > time.Minute {
+		t.Errorf("Unexpected fill time %s %v", headers.Get(FILL_TIME_META), err)
+	}
+}
+
+func TestPassthroughHeaders(t *testing.T) {
+	sourceHeader := http.Header{}
+	sourceHeader.Set("Cache-Control", "no-cache")
+	sourceHeader.Set("X-Amz-Meta-Build", "42")
+	sourceHeader.Set("X-Amz-Request-Id", "abc")
+	sourceHeader.Set("Server", "AmazonS3")
+
+	headers := passthroughHeaders([]string{"cache-control", "x-amz-meta-*"}, sourceHeader)
+	if len(headers) != 2 || headers.Get("Cache-Control") != "no-cache" || headers.Get("X-Amz-Meta-Build") != "42" {
+		t.Fatalf("Unexpected headers %v", headers)
+	}
+
+	if len(passthroughHeaders(nil, sourceHeader)) != 0 {
+		t.Fatal("Expected no headers without a passthrough list")
+	}
+}
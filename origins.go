@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Number of consecutive failures before an origin is considered unhealthy.
+const ORIGIN_MAX_FAILURES = 3
+
+// How long an unhealthy origin is skipped for before we try it again.
+const ORIGIN_BACKOFF = 30 * time.Second
+
+type origin struct {
+	URL *url.URL
+
+	// Consecutive failures (reset on success).
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// Ordered list of source origins with some basic health tracking so requests
+// fail over to the next origin when one is degraded. originSet is thread safe.
+type originSet struct {
+	sync.Mutex
+	origins []*origin
+}
+
+func newOriginSet(urls []*url.URL) *originSet {
+	origins := []*origin{}
+	for _, originURL := range urls {
+		origins = append(origins, &origin{URL: originURL})
+	}
+	return &originSet{origins: origins}
+}
+
+// Healthy origins (in their configured order) followed by the unhealthy ones
+// so they are still used as a last resort.
+func (self *originSet) Ordered() []*origin {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	healthy := []*origin{}
+	unhealthy := []*origin{}
+	for _, origin := range self.origins {
+		if now.Before(origin.unhealthyUntil) {
+			unhealthy = append(unhealthy, origin)
+		} else {
+			healthy = append(healthy, origin)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// The origin new requests should go to first.
+func (self *originSet) Primary() *origin {
+	return self.Ordered()[0]
+}
+
+func (self *originSet) Success(origin *origin) {
+	self.Lock()
+	defer self.Unlock()
+
+	origin.failures = 0
+	origin.unhealthyUntil = time.Time{}
+}
+
+func (self *originSet) Failure(origin *origin) {
+	self.Lock()
+	defer self.Unlock()
+
+	origin.failures++
+	if origin.failures >= ORIGIN_MAX_FAILURES {
+		log.Printf(
+			"Origin %s failed %d times skipping it for %v",
+			origin.URL, origin.failures, ORIGIN_BACKOFF,
+		)
+		origin.unhealthyUntil = time.Now().Add(ORIGIN_BACKOFF)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestOriginFailover(t *testing.T) {
+	primary, _ := url.Parse("https://primary.example.com")
+	secondary, _ := url.Parse("https://secondary.example.com")
+	origins := newOriginSet([]*url.URL{primary, secondary})
+
+	if origins.Primary().URL != primary {
+		t.Fatalf("Expected primary first got %s", origins.Primary().URL)
+	}
+
+	for i := 0; i < ORIGIN_MAX_FAILURES; i++ {
+		origins.Failure(origins.Ordered()[0])
+	}
+
+	ordered := origins.Ordered()
+	if ordered[0].URL != secondary || ordered[1].URL != primary {
+		t.Fatalf("Expected unhealthy primary last got %v", ordered)
+	}
+
+	origins.Success(ordered[1])
+	if origins.Primary().URL != primary {
+		t.Fatal("Expected primary to be healthy again after a success")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ids of the proxies a request went through (comma separated) so requests
+// between parent proxies cannot loop.
+const PROXY_VIA_HEADER = "X-S3-Copy-Proxy-Via"
+
+// How long a parent which failed is skipped for before we try it again.
+const PARENT_BACKOFF = 30 * time.Second
+
+// Parents are only asked whether they already have an object so this should
+// be quick. Their redirects (to their bucket) are a hit as they are, following
+// them would HEAD urls signed for a GET.
+var parentHeadClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type parent struct {
+	URL            *url.URL
+	unhealthyUntil time.Time
+}
+
+// Parent proxies in order of preference. Parents which cannot be reached are
+// skipped for a while (rather then every miss waiting on them) since the
+// origins can always be used instead. parentSet is thread safe.
+type parentSet struct {
+	sync.Mutex
+	parents []*parent
+}
+
+func newParentSet(urls []*url.URL) *parentSet {
+	parents := []*parent{}
+	for _, parentURL := range urls {
+		parents = append(parents, &parent{URL: parentURL})
+	}
+	return &parentSet{parents: parents}
+}
+
+// Parents which did not fail recently (in their configured order).
+func (self *parentSet) Healthy() []*parent {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	healthy := []*parent{}
+	for _, parent := range self.parents {
+		if !now.Before(parent.unhealthyUntil) {
+			healthy = append(healthy, parent)
+		}
+	}
+	return healthy
+}
+
+func (self *parentSet) Failure(parent *parent) {
+	self.Lock()
+	defer self.Unlock()
+
+	log.Printf("Parent %s failed skipping it for %v", parent.URL, PARENT_BACKOFF)
+	parent.unhealthyUntil = time.Now().Add(PARENT_BACKOFF)
+}
+
+// Whether the answer of a parent to the HEAD means it has the object (it
+// redirects hits to its bucket).
+func parentHit(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case 200, 302, 307:
+		return true
+	}
+	return false
+}
+
+// Parents answer 504 for objects they do not have, anything else over 500
+// means the parent itself is in trouble.
+func parentFailed(resp *http.Response) bool {
+	return resp.StatusCode >= 500 && resp.StatusCode != 504
+}
+
+// Whether the request already went through this proxy.
+func (self *Routes) seenByUs(req *http.Request) bool {
+	for _, value := range req.Header[http.CanonicalHeaderKey(PROXY_VIA_HEADER)] {
+		for _, id := range strings.Split(value, ",") {
+			if strings.TrimSpace(id) == self.config.ProxyID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Requests from child proxies which only want objects we already have.
+func onlyIfCached(req *http.Request) bool {
+	for _, directive := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		if strings.TrimSpace(strings.ToLower(directive)) == "only-if-cached" {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the url is of one of the parents of the config.
+func fromParent(config *ProxyConfig, sourceURL string) bool {
+	for _, parent := range config.Parents {
+		if strings.HasPrefix(sourceURL, parent.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Routes) newParentRequest(method string, parentURL *url.URL, req *http.Request) (*http.Request, error) {
+	parentReq, err := http.NewRequest(method, parentURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	via := self.config.ProxyID
+	if previous := req.Header.Get(PROXY_VIA_HEADER); previous != "" {
+		via = previous + ", " + via
+	}
+	parentReq.Header.Set(PROXY_VIA_HEADER, via)
+	// Parents must not go to the source on our behalf...
+	parentReq.Header.Set("Cache-Control", "only-if-cached")
+	// Always set so the transport never asks for (and transparently decodes)
+	// gzip itself, which would cache decoded bodies under encoded headers.
+	if acceptEncoding := req.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		parentReq.Header.Set("Accept-Encoding", acceptEncoding)
+	} else {
+		parentReq.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	return parentReq, nil
+}
+
+// Fetch the object from the first parent proxy which already has it (checked
+// with a HEAD so parents without it are cheap to skip). Returns nil when none
+// of them do.
+func (self *Routes) fetchParent(req *http.Request) (*http.Response, *url.URL) {
+	for _, parent := range self.parents.Healthy() {
+		parentURL := self.constructSourceUrl(&origin{URL: parent.URL}, req.URL)
+
+		headReq, err := self.newParentRequest("HEAD", &parentURL, req)
+		if err != nil {
+			log.Printf("Failed to generate parent request: %s", err)
+			continue
+		}
+
+		headResp, err := parentHeadClient.Do(headReq)
+		if err != nil {
+			log.Printf("Non fatal error checking parent %s %v", parent.URL.Host, err)
+			self.parents.Failure(parent)
+			continue
+		}
+		headResp.Body.Close()
+		if parentFailed(headResp) {
+			self.parents.Failure(parent)
+			continue
+		}
+		if !parentHit(headResp) {
+			continue
+		}
+
+		// ...but the object itself is fetched following the redirect.
+		getReq, err := self.newParentRequest("GET", &parentURL, req)
+		if err != nil {
+			continue
+		}
+		resp, err := httpClient.Do(getReq)
+		if err != nil {
+			log.Printf("Non fatal error fetching from parent %s %v", parent.URL.Host, err)
+			self.parents.Failure(parent)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			continue
+		}
+
+		log.Printf("Proxying %s -> parent %s", req.URL, &parentURL)
+		return resp, &parentURL
+	}
+	return nil, nil
+}
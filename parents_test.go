@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Child proxy with the parent proxy (served over http) as its only parent.
+func newTestParentProxies(t *testing.T) (*testProxy, *testProxy, func()) {
+	parent := newTestProxy(t, serveXFoo)
+	parent.config.ProxyID = "parent"
+	parent.reset()
+	parentServer := httptest.NewServer(parent.routes)
+
+	child := newTestProxy(t, serveXFoo)
+	child.config.ProxyID = "child"
+	child.config.Parents = parsePeers(t, parentServer.URL)
+	child.reset()
+
+	return parent, child, func() {
+		parentServer.Close()
+		parent.Close()
+		child.Close()
+	}
+}
+
+func TestIntegrationFillFromParent(t *testing.T) {
+	parent, child, cleanup := newTestParentProxies(t)
+	defer cleanup()
+
+	err := parent.bucket.PutHeader("production/parent", []byte("xfoo"), map[string][]string{
+		"Content-Type":      {"text/plain"},
+		"x-amz-meta-source": {"https://origin.example.com/parent"},
+	}, s3.PublicRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := child.get("/parent", nil)
+	child.expectRedirect(res, child.bucket.URL("production/parent"))
+	child.expectCached("production/parent", "xfoo")
+
+	if child.sourceCount("/parent") != 0 || parent.sourceCount("/parent") != 0 {
+		t.Fatal("Expected the object to come from the parent")
+	}
+
+	object, err := child.config.Store.Stat("production/parent")
+	if err != nil || object == nil {
+		t.Fatalf("Expected cached object %v", err)
+	}
+	if source := object.Header.Get("x-amz-meta-source"); source != "https://origin.example.com/parent" {
+		t.Fatalf("Expected the source recorded by the parent got %s", source)
+	}
+}
+
+func TestIntegrationFillFromParentGzip(t *testing.T) {
+	parent, child, cleanup := newTestParentProxies(t)
+	defer cleanup()
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("xfoo"))
+	writer.Close()
+
+	err := parent.bucket.PutHeader("production/parent.gz", compressed.Bytes(), map[string][]string{
+		"Content-Type":     {"text/plain"},
+		"Content-Encoding": {"gzip"},
+	}, s3.PublicRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The object is cached as it was encoded (not decoded by the transport)...
+	res := child.get("/parent.gz", http.Header{"Accept-Encoding": {"gzip"}})
+	child.expectRedirect(res, child.bucket.URL("production/parent.gz"))
+
+	cached, err := child.bucket.GetResponseWithHeaders("production/parent.gz", map[string][]string{
+		"Accept-Encoding": {"gzip"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(cached.Body)
+	cached.Body.Close()
+	if !bytes.Equal(content, compressed.Bytes()) {
+		t.Fatalf("Expected the gzipped body to be cached got %q", content)
+	}
+
+	object, err := child.config.Store.Stat("production/parent.gz")
+	if err != nil || object == nil {
+		t.Fatalf("Expected cached object %v", err)
+	}
+	if encoding := object.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Expected the object to keep its encoding got %s", encoding)
+	}
+	if child.sourceCount("/parent.gz") != 0 {
+		t.Fatal("Expected the object to come from the parent")
+	}
+}
+
+func TestIntegrationParentMiss(t *testing.T) {
+	parent, child, cleanup := newTestParentProxies(t)
+	defer cleanup()
+
+	res := child.get("/miss", nil)
+	child.expectRedirect(res, child.bucket.URL("production/miss"))
+	child.expectCached("production/miss", "xfoo")
+
+	// The parent is not asked to fill on our behalf...
+	if child.sourceCount("/miss") != 1 || parent.sourceCount("/miss") != 0 {
+		t.Fatalf(
+			"Expected the child to fill from its source got %d (parent %d)",
+			child.sourceCount("/miss"),
+			parent.sourceCount("/miss"),
+		)
+	}
+}
+
+func TestIntegrationParentLoop(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	res := proxy.get("/loop", http.Header{PROXY_VIA_HEADER: {"other, test-proxy"}})
+	if res.Code != 508 {
+		t.Fatalf("Expected loop to be detected got %d", res.Code)
+	}
+	if proxy.sourceCount("/loop") != 0 {
+		t.Fatal("Looping requests should not contact the source")
+	}
+}
+
+func TestIntegrationFillFromPrivateParent(t *testing.T) {
+	child := newTestProxy(t, serveXFoo)
+	defer child.Close()
+
+	// Hits redirect to urls signed for a GET (which refuse a HEAD)...
+	parent := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/signed" {
+			http.Redirect(res, req, "/signed?signature=get", 302)
+			return
+		}
+		if req.Method != "GET" {
+			res.WriteHeader(403)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte("xparent"))
+	}))
+	defer parent.Close()
+
+	child.config.Parents = parsePeers(t, parent.URL)
+	child.reset()
+
+	res := child.get("/private", nil)
+	child.expectRedirect(res, child.bucket.URL("production/private"))
+	child.expectCached("production/private", "xparent")
+	if child.sourceCount("/private") != 0 {
+		t.Fatal("Expected the object to come from the parent")
+	}
+}
+
+func TestIntegrationFailingParentIsSkipped(t *testing.T) {
+	child := newTestProxy(t, serveXFoo)
+	defer child.Close()
+
+	requests := 0
+	parent := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		res.WriteHeader(503)
+	}))
+	defer parent.Close()
+
+	child.config.Parents = parsePeers(t, parent.URL)
+	child.reset()
+
+	for _, path := range []string{"/first", "/second"} {
+		res := child.get(path, nil)
+		child.expectRedirect(res, child.bucket.URL("production"+path))
+		child.expectCached("production"+path, "xfoo")
+	}
+
+	// The second miss went straight to the source...
+	if requests != 1 {
+		t.Fatalf("Expected the failed parent to be asked once got %d", requests)
+	}
+}
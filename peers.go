@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set on requests forwarded to a peer (to the url of the forwarding proxy) so
+// the peer serves them itself rather then forwarding them again.
+const PEER_FORWARDED_HEADER = "X-S3-Copy-Proxy-Forwarded"
+
+// How long a peer which could not be reached is skipped for.
+const PEER_BACKOFF = 10 * time.Second
+
+type peer struct {
+	URL  *url.URL
+	self bool
+
+	unhealthyUntil time.Time
+}
+
+// Consistent hash ring of the proxies sharing the work of filling keys. Each
+// peer is placed on the ring at a number of (virtual) points so keys are
+// spread evenly and only the keys of a peer which joins or leaves move.
+// peerRing is thread safe.
+type peerRing struct {
+	sync.Mutex
+	peers []*peer
+
+	// Sorted hashes of the points and the peer at each point.
+	points []uint32
+	owners []*peer
+}
+
+// Ring of the peers (self is added when it is not one of them).
+func newPeerRing(urls []*url.URL, self *url.URL, virtualNodes int) *peerRing {
+	ring := &peerRing{}
+
+	selfAdded := false
+	for _, peerURL := range urls {
+		isSelf := samePeer(peerURL, self)
+		if isSelf && selfAdded {
+			continue
+		}
+		selfAdded = selfAdded || isSelf
+		ring.peers = append(ring.peers, &peer{URL: peerURL, self: isSelf})
+	}
+	if !selfAdded {
+		ring.peers = append(ring.peers, &peer{URL: self, self: true})
+	}
+
+	for _, peer := range ring.peers {
+		for i := 0; i < virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", peerKey(peer.URL), i)))
+			ring.points = append(ring.points, hash)
+			ring.owners = append(ring.owners, peer)
+		}
+	}
+	sort.Sort(ringPoints{ring})
+	return ring
+}
+
+type ringPoints struct {
+	ring *peerRing
+}
+
+func (self ringPoints) Len() int { return len(self.ring.points) }
+func (self ringPoints) Swap(i, j int) {
+	self.ring.points[i], self.ring.points[j] = self.ring.points[j], self.ring.points[i]
+	self.ring.owners[i], self.ring.owners[j] = self.ring.owners[j], self.ring.owners[i]
+}
+func (self ringPoints) Less(i, j int) bool {
+	if self.ring.points[i] != self.ring.points[j] {
+		return self.ring.points[i] < self.ring.points[j]
+	}
+	// Collisions are broken the same way on every peer...
+	return peerKey(self.ring.owners[i].URL) < peerKey(self.ring.owners[j].URL)
+}
+
+// Peers are identified by their scheme and host (the path is ignored).
+func peerKey(peerURL *url.URL) string {
+	return strings.ToLower(peerURL.Scheme + "://" + peerURL.Host)
+}
+
+func samePeer(a, b *url.URL) bool {
+	return peerKey(a) == peerKey(b)
+}
+
+// Healthy peer owning the key (the next healthy one along the ring when the
+// owner is not). Returns nil when the key is ours.
+func (self *peerRing) Owner(key string) *peer {
+	self.Lock()
+	defer self.Unlock()
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(self.points), func(i int) bool {
+		return self.points[i] >= hash
+	})
+
+	now := time.Now()
+	for i := 0; i < len(self.owners); i++ {
+		owner := self.owners[(start+i)%len(self.owners)]
+		if owner.self {
+			return nil
+		}
+		if now.After(owner.unhealthyUntil) {
+			return owner
+		}
+	}
+	return nil
+}
+
+func (self *peerRing) Failure(peer *peer) {
+	self.Lock()
+	defer self.Unlock()
+
+	log.Printf("Peer %s failed skipping it for %v", peer.URL, PEER_BACKOFF)
+	peer.unhealthyUntil = time.Now().Add(PEER_BACKOFF)
+}
+
+// Forward the request to the peer owning the key (if that is not us). Returns
+// false when the request should be served locally, including when the peer
+// cannot be reached (so a peer leaving only costs a fill here rather then a
+// failed request).
+func (self *Routes) forwardToPeer(key string, res http.ResponseWriter, req *http.Request) bool {
+	if self.peers == nil || req.Header.Get(PEER_FORWARDED_HEADER) != "" {
+		return false
+	}
+
+	owner := self.peers.Owner(key)
+	if owner == nil {
+		return false
+	}
+
+	failed := false
+	forwarder := &httputil.ReverseProxy{
+		Director: func(peerReq *http.Request) {
+			// The routed request has the route path stripped so use what the
+			// client asked for...
+			requestURI := req.RequestURI
+			if requestURI == "" {
+				requestURI = req.URL.RequestURI()
+			}
+			target, err := url.Parse(requestURI)
+			if err != nil {
+				target = &url.URL{Path: req.URL.Path}
+			}
+
+			peerReq.URL.Scheme = owner.URL.Scheme
+			peerReq.URL.Host = owner.URL.Host
+			peerReq.URL.Path = target.Path
+			peerReq.URL.RawPath = ""
+			peerReq.URL.RawQuery = target.RawQuery
+			// Keep the host so routes match the same way on the peer.
+			peerReq.Host = req.Host
+			peerReq.Header.Set(PEER_FORWARDED_HEADER, self.config.PeerSelf.String())
+		},
+		ErrorHandler: func(res http.ResponseWriter, peerReq *http.Request, err error) {
+			log.Printf("Cannot forward %s to peer %s serving it locally %v", key, owner.URL, err)
+			failed = true
+		},
+	}
+
+	log.Printf("Forwarding %s to peer %s", key, owner.URL)
+	forwarder.ServeHTTP(res, req)
+
+	if failed {
+		self.peers.Failure(owner)
+		return false
+	}
+	return true
+}
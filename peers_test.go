@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func parsePeers(t *testing.T, peers ...string) []*url.URL {
+	urls := []*url.URL{}
+	for _, peer := range peers {
+		peerURL, err := url.Parse(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, peerURL)
+	}
+	return urls
+}
+
+// Url of the owner of the key as seen by the ring.
+func ownerOf(ring *peerRing, self, key string) string {
+	if owner := ring.Owner(key); owner != nil {
+		return owner.URL.String()
+	}
+	return self
+}
+
+func TestPeerRingSpreadsKeys(t *testing.T) {
+	peers := parsePeers(t, "http://a:8080", "http://b:8080", "http://c:8080")
+	ring := newPeerRing(peers, peers[0], 100)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ownerOf(ring, "http://a:8080", fmt.Sprintf("production/%d", i))]++
+	}
+	for _, peer := range peers {
+		if counts[peer.String()] < 700 {
+			t.Errorf("Expected keys to be spread evenly got %v", counts)
+		}
+	}
+}
+
+func TestPeerRingAgreesAcrossPeers(t *testing.T) {
+	a := newPeerRing(parsePeers(t, "http://a:8080", "http://b:8080", "http://c:8080"), parsePeers(t, "http://a:8080")[0], 100)
+	c := newPeerRing(parsePeers(t, "http://c:8080", "http://b:8080", "http://a:8080"), parsePeers(t, "http://c:8080")[0], 100)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("production/%d", i)
+		if ownerOf(a, "http://a:8080", key) != ownerOf(c, "http://c:8080", key) {
+			t.Fatalf("Peers disagree on the owner of %s", key)
+		}
+	}
+}
+
+func TestPeerRingLeave(t *testing.T) {
+	self := parsePeers(t, "http://a:8080")[0]
+	before := newPeerRing(parsePeers(t, "http://a:8080", "http://b:8080", "http://c:8080"), self, 100)
+	after := newPeerRing(parsePeers(t, "http://a:8080", "http://b:8080"), self, 100)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("production/%d", i)
+		owner := ownerOf(before, "http://a:8080", key)
+		// Only the keys of the peer which left should move...
+		if owner != "http://c:8080" && ownerOf(after, "http://a:8080", key) != owner {
+			t.Fatalf("Key %s moved from %s", key, owner)
+		}
+	}
+}
+
+func TestPeerRingSkipsFailedPeers(t *testing.T) {
+	peers := parsePeers(t, "http://a:8080", "http://b:8080")
+	ring := newPeerRing(peers, peers[0], 100)
+
+	key := ""
+	for i := 0; ring.Owner(key) == nil; i++ {
+		key = fmt.Sprintf("production/%d", i)
+	}
+
+	ring.Failure(ring.Owner(key))
+	if ring.Owner(key) != nil {
+		t.Fatal("Expected keys of a failed peer to be ours")
+	}
+}
+
+func TestIntegrationPeerForwarding(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	forwarded := []*http.Request{}
+	peer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		forwarded = append(forwarded, req)
+		http.Redirect(res, req, "http://bucket.example.com"+req.URL.Path, 302)
+	}))
+	defer peer.Close()
+
+	proxy.config.Peers = parsePeers(t, peer.URL)
+	proxy.config.PeerSelf = parsePeers(t, "http://self:8080")[0]
+	proxy.config.PeerVirtualNodes = 100
+	proxy.reset()
+
+	// Find a key the peer owns...
+	path := ""
+	for i := 0; path == "" || proxy.routes.peers.Owner(proxy.routes.constructKeyName(&url.URL{Path: path})) == nil; i++ {
+		path = fmt.Sprintf("/peer/%d", i)
+	}
+
+	res := proxy.get(path, nil)
+	proxy.expectRedirect(res, "http://bucket.example.com"+path)
+	if len(forwarded) != 1 || forwarded[0].Header.Get(PEER_FORWARDED_HEADER) != "http://self:8080" {
+		t.Fatalf("Expected request to be forwarded to the peer got %v", forwarded)
+	}
+	if proxy.sourceCount(path) != 0 {
+		t.Fatal("Expected the peer to fill the key")
+	}
+
+	// Requests forwarded to us are always ours...
+	res = proxy.get(path, http.Header{PEER_FORWARDED_HEADER: {peer.URL}})
+	proxy.expectRedirect(res, proxy.bucket.URL("production"+path))
+	if len(forwarded) != 1 || proxy.sourceCount(path) != 1 {
+		t.Fatalf("Expected a local fill got %d forwards", len(forwarded))
+	}
+}
+
+func TestIntegrationPeerDown(t *testing.T) {
+	proxy := newTestProxy(t, serveXFoo)
+	defer proxy.Close()
+
+	peer := httptest.NewServer(http.NotFoundHandler())
+	peer.Close()
+
+	proxy.config.Peers = parsePeers(t, peer.URL)
+	proxy.config.PeerSelf = parsePeers(t, "http://self:8080")[0]
+	proxy.config.PeerVirtualNodes = 100
+	proxy.reset()
+
+	path := ""
+	for i := 0; path == "" || proxy.routes.peers.Owner(proxy.routes.constructKeyName(&url.URL{Path: path})) == nil; i++ {
+		path = fmt.Sprintf("/peer/%d", i)
+	}
+
+	res := proxy.get(path, nil)
+	proxy.expectRedirect(res, proxy.bucket.URL("production"+path))
+	if proxy.sourceCount(path) != 1 {
+		t.Fatal("Expected a local fill when the peer is down")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"github.com/goamz/goamz/s3"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Top level http.Handler which can be (re)loaded from a Config at any time.
+// Requests already in progress finish with the routes they started with.
+type Proxy struct {
+	sync.RWMutex
+	metrics     *Metrics
+	hostDetails *HostDetails
+	started     time.Time
+
+	handler http.Handler
+	config  *Config
+	routes  []loadedRoute
+
+	// Last result of the readiness checks.
+	readiness readinessCache
+
+	// Kept across reloads (by store name) so fills started before a reload
+	// are still waited on (rather then repeated) after it.
+	requests  map[string]*requestMutex
+	accessed  map[string]*accessLog
+	diskCache *DiskCache
+
+	// Closed to stop the janitors of the current routes.
+	stopJanitors chan bool
+
+	// Lifecycle rules installed by bucket name.
+	lifecycles map[string]*bucketLifecycle
+}
+
+func NewProxy(metrics *Metrics, hostDetails *HostDetails) *Proxy {
+	return &Proxy{
+		metrics:     metrics,
+		hostDetails: hostDetails,
+		started:     time.Now(),
+		requests:    make(map[string]*requestMutex),
+		accessed:    make(map[string]*accessLog),
+		lifecycles:  make(map[string]*bucketLifecycle),
+	}
+}
+
+// Must be called while holding the lock.
+func (self *Proxy) requestMutex(store string) *requestMutex {
+	requests := self.requests[store]
+	if requests == nil {
+		requests = newRequestMutex()
+		self.requests[store] = requests
+	}
+	return requests
+}
+
+// Must be called while holding the lock.
+func (self *Proxy) accessLog(store string) *accessLog {
+	accessed := self.accessed[store]
+	if accessed == nil {
+		accessed = newAccessLog()
+		self.accessed[store] = accessed
+	}
+	return accessed
+}
+
+// Wait for the fills in progress (of every store) to complete. Returns false
+// if the context is done first.
+func (self *Proxy) waitForFills(ctx context.Context) bool {
+	self.RLock()
+	requests := []*requestMutex{}
+	for _, storeRequests := range self.requests {
+		requests = append(requests, storeRequests)
+	}
+	self.RUnlock()
+
+	done := make(chan bool)
+	go func() {
+		for _, storeRequests := range requests {
+			storeRequests.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stop accepting connections and wait (up to the shutdown timeout) for the
+// requests and fills in progress before flushing the metrics. Multipart
+// uploads still running at the deadline are aborted.
+func (self *Proxy) Shutdown(server *http.Server) {
+	self.Lock()
+	timeout := self.config.ShutdownTimeout
+	if self.stopJanitors != nil {
+		close(self.stopJanitors)
+		self.stopJanitors = nil
+	}
+	self.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Waiters are requests like any other...
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Timed out waiting for requests to finish %v", err)
+	}
+
+	// ...but fills may outlive the requests which started them.
+	if !self.waitForFills(ctx) {
+		aborted := activeMultipartUploads.AbortAll()
+		log.Printf("Timed out waiting for fills to finish (aborted %d multipart uploads)", aborted)
+	}
+
+	if self.metrics.Active {
+		err = self.metrics.SendMetrics()
+		if err != nil {
+			log.Printf("Non fatal error while sending metrics %v", err)
+		}
+	}
+}
+
+// Build the routes for the config and swap them in.
+func (self *Proxy) Load(config *Config) error {
+	self.Lock()
+	defer self.Unlock()
+
+	diskCache := self.diskCache
+	if config.DiskCacheDir == "" {
+		diskCache = nil
+	} else if diskCache == nil || diskCache.dir != config.DiskCacheDir {
+		var err error
+		diskCache, err = NewDiskCache(config.DiskCacheDir, config.DiskCacheSize, config.DiskCacheMaxAge)
+		if err != nil {
+			return err
+		}
+	} else {
+		diskCache.SetLimits(config.DiskCacheSize, config.DiskCacheMaxAge)
+	}
+	config.Proxy.DiskCache = diskCache
+
+	type pendingRoute struct {
+		host, path string
+		config     *ProxyConfig
+	}
+	pending := []pendingRoute{}
+	for _, routeConfig := range config.Routes {
+		proxyConfig, err := routeConfig.ProxyConfig(&config.Proxy, config.Auth)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, pendingRoute{routeConfig.Host, routeConfig.Path, proxyConfig})
+	}
+
+	// Anything not matched by the routing table goes to the default source
+	// (when there is one).
+	if len(config.Proxy.Sources) > 0 {
+		pending = append(pending, pendingRoute{"", "/", &config.Proxy})
+	}
+
+	// Every route of a store shares its key index (which depends on all of
+	// them)...
+	storeConfigs := map[string][]*ProxyConfig{}
+	for _, route := range pending {
+		name := route.config.Store.Name()
+		storeConfigs[name] = append(storeConfigs[name], route.config)
+	}
+	indexes := map[string]*keyIndex{}
+	for name, configs := range storeConfigs {
+		indexes[name] = newStoreKeyIndex(configs)
+	}
+
+	router := NewRouter()
+	allRoutes := []*Routes{}
+	loaded := []loadedRoute{}
+	for _, route := range pending {
+		proxyConfig := route.config
+		name := proxyConfig.Store.Name()
+		metricsFactory := NewMetricFactory(self.hostDetails, proxyConfig)
+		routes := NewRoutes(
+			proxyConfig,
+			self.requestMutex(name),
+			self.accessLog(name),
+			indexes[name],
+			self.metrics,
+			&metricsFactory,
+		)
+		allRoutes = append(allRoutes, &routes)
+		loaded = append(loaded, loadedRoute{host: route.host, path: route.path, routes: &routes})
+		router.Add(route.host, route.path, routes)
+		log.Printf("Routing host=%s path=%s to store %s", route.host, route.path, name)
+	}
+
+	err := checkRouteKeys(loaded)
+	if err != nil {
+		return err
+	}
+
+	if self.config != nil && self.config.Port != config.Port {
+		log.Printf("Port changes require a restart (still listening on %d)", self.config.Port)
+	}
+
+	self.handler = router
+	self.config = config
+	self.routes = loaded
+	self.diskCache = diskCache
+
+	if self.stopJanitors != nil {
+		close(self.stopJanitors)
+	}
+	self.stopJanitors = make(chan bool)
+
+	for _, routes := range allRoutes {
+		go routes.ScanIndex()
+		if routes.janitorEnabled() {
+			go routes.RunJanitor(self.stopJanitors)
+		}
+	}
+
+	self.updateLifecycleRules(allRoutes)
+	return nil
+}
+
+// Lifecycle rules of a bucket (so they are only installed again when they
+// change).
+type bucketLifecycle struct {
+	bucket *s3.Bucket
+	rules  []lifecycleRule
+}
+
+// Lifecycle rules of all routes grouped by bucket (since each bucket has a
+// single lifecycle configuration).
+func lifecycleRulesByBucket(allRoutes []*Routes) map[string]*bucketLifecycle {
+	buckets := map[string]*s3.Bucket{}
+	days := map[string]map[string]int{}
+	for _, routes := range allRoutes {
+		store, ok := routes.config.Store.(*S3Store)
+		if !ok || routes.config.LifecycleDays <= 0 {
+			continue
+		}
+
+		name := store.Name()
+		if days[name] == nil {
+			buckets[name] = store.Bucket
+			days[name] = map[string]int{}
+		}
+		// Routes sharing a prefix get a single rule (the shortest expiry wins).
+		prefix := routes.storePrefix()
+		if current, ok := days[name][prefix]; !ok || routes.config.LifecycleDays < current {
+			days[name][prefix] = routes.config.LifecycleDays
+		}
+	}
+
+	lifecycles := map[string]*bucketLifecycle{}
+	for name, bucket := range buckets {
+		lifecycle := &bucketLifecycle{bucket: bucket}
+		for prefix, expiry := range days[name] {
+			lifecycle.rules = append(lifecycle.rules, lifecycleRule{Prefix: prefix, Days: expiry})
+		}
+		sort.Sort(lifecycleRulesByPrefix(lifecycle.rules))
+		lifecycles[name] = lifecycle
+	}
+	return lifecycles
+}
+
+type lifecycleRulesByPrefix []lifecycleRule
+
+func (self lifecycleRulesByPrefix) Len() int           { return len(self) }
+func (self lifecycleRulesByPrefix) Less(i, j int) bool { return self[i].Prefix < self[j].Prefix }
+func (self lifecycleRulesByPrefix) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Install the lifecycle rules of buckets whose rules changed since they were
+// last installed (rather then on every reload). Buckets which no longer have
+// any rules get the rules installed before removed.
+//
+// Must be called while holding the lock.
+func (self *Proxy) updateLifecycleRules(allRoutes []*Routes) {
+	lifecycles := lifecycleRulesByBucket(allRoutes)
+	for name, installed := range self.lifecycles {
+		if lifecycles[name] == nil && len(installed.rules) > 0 {
+			lifecycles[name] = &bucketLifecycle{bucket: installed.bucket}
+		}
+	}
+
+	for name, lifecycle := range lifecycles {
+		installed := self.lifecycles[name]
+		if installed != nil && reflect.DeepEqual(installed.rules, lifecycle.rules) {
+			continue
+		}
+		self.lifecycles[name] = lifecycle
+		go self.installLifecycleRules(name, lifecycle)
+	}
+}
+
+func (self *Proxy) installLifecycleRules(name string, lifecycle *bucketLifecycle) {
+	err := putLifecycleRules(lifecycle.bucket, lifecycle.rules)
+	if err == nil {
+		log.Printf("Installed %d lifecycle rules on %s", len(lifecycle.rules), name)
+		return
+	}
+
+	log.Printf("Non fatal error installing lifecycle rules %v", err)
+	// Try again on the next reload...
+	self.Lock()
+	defer self.Unlock()
+	if self.lifecycles[name] == lifecycle {
+		delete(self.lifecycles, name)
+	}
+}
+
+func (self *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if self.serveAdmin(res, req) {
+		return
+	}
+
+	self.RLock()
+	handler := self.handler
+	self.RUnlock()
+
+	handler.ServeHTTP(res, req)
+}
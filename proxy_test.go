@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Proxy (served over http) with the default route of the test proxy whose
+// source blocks until released.
+func newTestShutdownProxy(t *testing.T, shutdownTimeout time.Duration) (*Proxy, *httptest.Server, *testProxy, chan bool) {
+	release := make(chan bool)
+	routes := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		serveXFoo(res, req)
+	})
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	err := proxy.Load(&Config{Proxy: *routes.config, ShutdownTimeout: shutdownTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy, httptest.NewServer(proxy), routes, release
+}
+
+func TestProxyShutdownWaitsForFills(t *testing.T) {
+	proxy, server, routes, release := newTestShutdownProxy(t, time.Minute)
+	defer routes.Close()
+
+	// The client gives up waiting but the fill carries on...
+	req, _ := http.NewRequest("GET", server.URL+"/drain", nil)
+	req.Header.Set(MAX_WAIT_HEADER, "10ms")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	stopped := make(chan bool)
+	go func() {
+		proxy.Shutdown(server.Config)
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown did not wait for the fill")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-stopped
+	routes.expectCached("production/drain", "xfoo")
+
+	// No new connections are accepted...
+	_, err = http.Get(server.URL + "/drain")
+	if err == nil {
+		t.Fatal("Expected the server to be closed")
+	}
+}
+
+func TestProxyShutdownTimeout(t *testing.T) {
+	proxy, server, routes, release := newTestShutdownProxy(t, 50*time.Millisecond)
+	defer routes.Close()
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", server.URL+"/stuck", nil)
+	req.Header.Set(MAX_WAIT_HEADER, "10ms")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	start := time.Now()
+	proxy.Shutdown(server.Config)
+	if waited := time.Now().Sub(start); waited > 5*time.Second {
+		t.Fatalf("Expected shutdown to give up on the fill got %v", waited)
+	}
+}
+
+func TestProxyRejectsRoutesSharingKeys(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	load := func(prefixA, prefixB string) error {
+		proxy := NewProxy(&Metrics{}, &HostDetails{})
+		return proxy.Load(&Config{Proxy: *routes.config, Routes: []RouteConfig{
+			{Path: "/a", Sources: []string{routes.source.URL}, Prefix: prefixA},
+			{Path: "/b", Sources: []string{routes.source.URL}, Prefix: prefixB},
+		}})
+	}
+
+	// Both routes (and the default route) would cache /x/foo as
+	// production/foo...
+	if err := load("", ""); err == nil {
+		t.Fatal("Expected routes inheriting the same bucket and prefix to be rejected")
+	}
+	// ...nested prefixes overlap too...
+	if err := load("production/a", "b"); err == nil {
+		t.Fatal("Expected a prefix under the default prefix to be rejected")
+	}
+	if err := load("a", "b"); err != nil {
+		t.Fatalf("Expected routes with their own prefixes to load %v", err)
+	}
+}
+
+func TestIntegrationRoutesDoNotShareObjects(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	sourceB := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte("xbar"))
+	}))
+	defer sourceB.Close()
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	err := proxy.Load(&Config{Proxy: *routes.config, Routes: []RouteConfig{
+		{Path: "/a", Sources: []string{routes.source.URL}, Prefix: "a"},
+		{Path: "/b", Sources: []string{sourceB.URL}, Prefix: "b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a/foo", "/b/foo"} {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	routes.expectCached("a/foo", "xfoo")
+	routes.expectCached("b/foo", "xbar")
+}
+
+func TestProxySharesKeyIndexPerStore(t *testing.T) {
+	routes := newTestProxy(t, serveXFoo)
+	defer routes.Close()
+
+	config := *routes.config
+	config.IndexSize = 10
+	config.IndexTTL = time.Hour
+	config.JanitorInterval = time.Hour
+	config.Sources = nil
+
+	proxy := NewProxy(&Metrics{}, &HostDetails{})
+	err := proxy.Load(&Config{Proxy: config, Routes: []RouteConfig{
+		{Path: "/a", Sources: []string{routes.source.URL}, Prefix: "a"},
+		{Path: "/b", Sources: []string{routes.source.URL}, Prefix: "b", ExpireAfter: "1h"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(proxy.stopJanitors)
+
+	a, b := proxy.routes[0].routes, proxy.routes[1].routes
+	if a.index == nil || a.index != b.index {
+		t.Fatalf("Expected the routes of a store to share their key index got %p %p", a.index, b.index)
+	}
+	if a.index.positiveTTL != 0 {
+		t.Fatalf("Expected hits not to be indexed while the store expires objects got %v", a.index.positiveTTL)
+	}
+}
@@ -10,23 +10,29 @@ type requestMutex struct {
 
 	// The key is intended to be the path part of the request url...
 	requests map[string]*chan bool
+
+	// Requests which were created but not completed yet.
+	pending sync.WaitGroup
+
+	// Number of requests waiting on others to complete.
+	waiters int
 }
 
-func newRequestMutex() requestMutex {
+func newRequestMutex() *requestMutex {
 	requests := make(map[string]*chan bool)
-	return requestMutex{
+	return &requestMutex{
 		requests: requests,
 	}
 }
 
-func (self requestMutex) Get(name string) *chan bool {
+func (self *requestMutex) Get(name string) *chan bool {
 	defer self.Unlock()
 	self.Lock()
 
 	return self.requests[name]
 }
 
-func (self requestMutex) Create(name string) (*chan bool, error) {
+func (self *requestMutex) Create(name string) (*chan bool, error) {
 	defer self.Unlock()
 	self.Lock()
 
@@ -37,18 +43,44 @@ func (self requestMutex) Create(name string) (*chan bool, error) {
 	}
 
 	self.requests[name] = &observer
+	self.pending.Add(1)
 	return &observer, nil
 }
 
 // Complete and remove the request.
-func (self requestMutex) Complete(name string, obj *chan bool) error {
+func (self *requestMutex) Complete(name string, obj *chan bool) error {
 	defer self.Unlock()
 	self.Lock()
 
 	if self.requests[name] == obj {
 		close(*obj)
 		delete(self.requests, name)
+		self.pending.Done()
 		return nil
 	}
 	return fmt.Errorf("Unknown request name %s", name)
 }
+
+// Wait for every request created so far to complete.
+func (self *requestMutex) Wait() {
+	self.pending.Wait()
+}
+
+func (self *requestMutex) AddWaiter() {
+	defer self.Unlock()
+	self.Lock()
+	self.waiters++
+}
+
+func (self *requestMutex) RemoveWaiter() {
+	defer self.Unlock()
+	self.Lock()
+	self.waiters--
+}
+
+// Number of requests in progress and requests waiting on them.
+func (self *requestMutex) Counts() (int, int) {
+	defer self.Unlock()
+	self.Lock()
+	return len(self.requests), self.waiters
+}
@@ -32,3 +32,29 @@ func TestMultipleConsumers(t *testing.T) {
 	requests.Complete(key, requestDone)
 	wg.Wait()
 }
+
+func TestWaitForPendingRequests(t *testing.T) {
+	requests := newRequestMutex()
+
+	// Nothing to wait for...
+	requests.Wait()
+
+	first, _ := requests.Create("first")
+	second, _ := requests.Create("second")
+
+	waited := make(chan bool)
+	go func() {
+		requests.Wait()
+		close(waited)
+	}()
+
+	requests.Complete("first", first)
+	select {
+	case <-waited:
+		t.Fatal("Wait returned before every request completed")
+	default:
+	}
+
+	requests.Complete("second", second)
+	<-waited
+}
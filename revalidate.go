@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Number of recently validated keys to remember.
+const VALIDATED_CACHE_SIZE = 100000
+
+// Metadata recorded on cached objects so they can be revalidated later.
+const (
+	SOURCE_ETAG_META          = "x-amz-meta-source-etag"
+	SOURCE_LAST_MODIFIED_META = "x-amz-meta-source-last-modified"
+)
+
+// Like `http.ParseTime` but also accepts RFC1123 times in zones other then GMT
+// (which some s3 compatible stores send).
+func parseHTTPTime(value string) (time.Time, error) {
+	parsed, err := http.ParseTime(value)
+	if err != nil {
+		return time.Parse(time.RFC1123, value)
+	}
+	return parsed, nil
+}
+
+// Check if the cached copy of the key is older then the configured max age
+// and if so ask the source (with a conditional HEAD) if it has changed since.
+// Returns true when the cached copy should be replaced. Any errors along the
+// way are logged and the cached copy is kept.
+func (self *Routes) isStale(key string, req *http.Request) bool {
+	if self.config.RevalidateAfter <= 0 {
+		return false
+	}
+
+	if _, ok := self.validated.Get(key); ok {
+		return false
+	}
+
+	// Nothing to revalidate if we already know the key is not cached.
+	if exists, known := self.index.Lookup(key); known && !exists {
+		return false
+	}
+
+	cached, err := self.config.Store.Stat(key)
+	if err != nil || cached == nil {
+		return false
+	}
+
+	filled := cached.LastModified
+	if filled.IsZero() {
+		log.Printf("Cannot revalidate %s without a last modified time", key)
+		return false
+	}
+
+	age := time.Now().Sub(filled)
+	if age < self.config.RevalidateAfter {
+		self.validated.Set(key, true, self.config.RevalidateAfter-age)
+		return false
+	}
+
+	sourceURL := self.constructSourceUrl(self.origins.Primary(), req.URL)
+	sourceReq, err := http.NewRequest("HEAD", sourceURL.String(), nil)
+	if err != nil {
+		log.Printf("Failed to generate revalidation request: %s", err)
+		return false
+	}
+
+	// Objects without a recorded etag (the source sent none) are compared
+	// against the time they were cached instead.
+	etag := cached.Header.Get(SOURCE_ETAG_META)
+	if etag != "" {
+		sourceReq.Header.Set("If-None-Match", etag)
+	} else {
+		sourceReq.Header.Set("If-Modified-Since", filled.UTC().Format(http.TimeFormat))
+	}
+	signSourceRequest(self.config, sourceReq)
+
+	sourceResp, err := httpClient.Do(sourceReq)
+	if err != nil {
+		log.Printf("Failed to revalidate %s with source %v", key, err)
+		return false
+	}
+	sourceResp.Body.Close()
+
+	changed := sourceResp.StatusCode == 200 &&
+		(etag == "" || sourceResp.Header.Get("ETag") != etag)
+
+	if sourceResp.StatusCode != 200 && sourceResp.StatusCode != 304 {
+		log.Printf(
+			"Unexpected status %d revalidating %s keeping cached copy",
+			sourceResp.StatusCode,
+			key,
+		)
+		return false
+	}
+
+	self.metrics.Send(self.metricsFactory.CacheRevalidate(age, changed))
+	if !changed {
+		self.validated.Set(key, true, self.config.RevalidateAfter)
+		return false
+	}
+
+	log.Printf("Cached copy of %s changed at the source", key)
+	self.index.Remove(key)
+	if self.config.DiskCache != nil {
+		self.config.DiskCache.Remove(self.diskKey(key))
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHTTPTime(t *testing.T) {
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sun, 06 Nov 1994 08:49:37 UTC",
+	} {
+		parsed, err := parseHTTPTime(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.Year() != 1994 || parsed.Hour() != 8 {
+			t.Fatalf("Unexpected time %v from %s", parsed, value)
+		}
+	}
+
+	if _, err := parseHTTPTime("yesterday"); err == nil {
+		t.Fatal("Expected invalid times to fail")
+	}
+}
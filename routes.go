@@ -1,33 +1,108 @@
 package main
 
 import (
-	"github.com/goamz/goamz/s3"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var httpClient = &http.Client{}
 
-const MAX_SOURCE_PULL_WAIT = 90 * time.Second
 const MAX_WAIT_HEADER = "x-max-wait-duration"
 
+// Headers which may cause the source to respond with less then the full
+// object.
+var partialRequestHeaders = map[string]bool{
+	"Range":               true,
+	"If-Range":            true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+}
+
+// Maximum number of failed source requests to remember.
+const NEGATIVE_CACHE_SIZE = 10000
+
 type Routes struct {
 	config         *ProxyConfig
-	requests       requestMutex
+	requests       *requestMutex
+	accessed       *accessLog
 	metrics        *Metrics
 	metricsFactory *MetricFactory
+
+	// Known state of keys in the bucket shared by the routes of the store
+	// (nil when disabled).
+	index *keyIndex
+
+	// Status codes of recent failed source requests by key.
+	failures *ttlCache
+
+	// Keys which do not need to be revalidated against the source (yet).
+	validated *ttlCache
+
+	// Source origins in order of preference.
+	origins *originSet
+
+	// Parent proxies asked before the origins.
+	parents *parentSet
+
+	// Other proxies keys are spread across (nil when there are none).
+	peers *peerRing
 }
 
-func NewRoutes(config *ProxyConfig, metrics *Metrics, metricsFactory *MetricFactory) Routes {
+// Routes sharing a bucket must also share their requestMutex (so only one of
+// them fills a given key), accessLog and keyIndex (so evictions by any of them
+// are seen by all).
+func NewRoutes(
+	config *ProxyConfig,
+	requests *requestMutex,
+	accessed *accessLog,
+	index *keyIndex,
+	metrics *Metrics,
+	metricsFactory *MetricFactory,
+) Routes {
+	var peers *peerRing
+	if len(config.Peers) > 0 {
+		peers = newPeerRing(config.Peers, config.PeerSelf, config.PeerVirtualNodes)
+	}
+
 	return Routes{
 		config:         config,
-		requests:       newRequestMutex(),
+		requests:       requests,
+		accessed:       accessed,
 		metrics:        metrics,
 		metricsFactory: metricsFactory,
+		index:          index,
+		failures:       newTTLCache(NEGATIVE_CACHE_SIZE),
+		validated:      newTTLCache(VALIDATED_CACHE_SIZE),
+		origins:        newOriginSet(config.Sources),
+		parents:        newParentSet(config.Parents),
+		peers:          peers,
+	}
+}
+
+// Prefix of all our keys in the store.
+func (self *Routes) storePrefix() string {
+	prefix := strings.TrimPrefix(self.config.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// Seed the key index with the objects already in the bucket under our prefix.
+func (self *Routes) ScanIndex() {
+	err := self.index.Scan(self.config.Store, self.storePrefix())
+	if err != nil {
+		log.Printf("Non fatal error scanning bucket into key index %v", err)
 	}
 }
 
@@ -40,59 +115,146 @@ func (self *Routes) constructKeyName(reqUrl *url.URL) string {
 	return key
 }
 
-func (self *Routes) constructSourceUrl(reqUrl *url.URL) url.URL {
-	src := *self.config.Source
+func (self *Routes) constructSourceUrl(origin *origin, reqUrl *url.URL) url.URL {
+	src := *origin.URL
 	src.Path = path.Join(src.Path, reqUrl.Path)
 	return src
 }
 
 func (self *Routes) redirectToSource(res http.ResponseWriter, req *http.Request) {
-	source := self.constructSourceUrl(req.URL)
+	source := self.constructSourceUrl(self.origins.Primary(), req.URL)
 	http.Redirect(res, req, source.String(), 302)
 }
 
-// Attempt to redirect the given request to the cache bucket.
+// Remember source responses which are not worth asking for again (for a while).
+func (self *Routes) rememberSourceFailure(key string, status int) {
+	if self.config.NegativeCacheTTL <= 0 {
+		return
+	}
+
+	if status == 403 || status == 404 || status >= 500 {
+		log.Printf("Remembering source status %d for %s", status, key)
+		self.failures.Set(key, status, self.config.NegativeCacheTTL)
+	}
+}
+
+// Respond to requests which recently failed at the source without asking the
+// source again.
+func (self *Routes) attemptNegativeCacheHit(key string, res http.ResponseWriter, req *http.Request) bool {
+	value, ok := self.failures.Get(key)
+	if !ok {
+		return false
+	}
+
+	status := value.(int)
+	self.metrics.Send(self.metricsFactory.NegativeCacheHit(status))
+	if self.config.NegativeCacheRespond {
+		http.Error(res, http.StatusText(status), status)
+	} else {
+		self.redirectToSource(res, req)
+	}
+	return true
+}
+
+// Attempt to serve the given request from the local disk cache (if enabled).
+func (self *Routes) serveFromDisk(key string, res http.ResponseWriter, req *http.Request) bool {
+	if self.config.DiskCache == nil {
+		return false
+	}
+	if !self.config.DiskCache.Serve(self.diskKey(key), res, req) {
+		return false
+	}
+	self.accessed.Touch(key)
+	return true
+}
+
+// The disk cache may be shared by routes with different stores so keys are
+// qualified with the store name.
+func (self *Routes) diskKey(key string) string {
+	return self.config.Store.Name() + "/" + key
+}
+
+// Attempt to redirect the given request to (or serve it from) the cache store.
 func (self *Routes) attemptCacheRedirect(key string, res http.ResponseWriter, req *http.Request) bool {
-	bucketKeyExists, err := self.config.Bucket.Exists(key)
+	bucketKeyExists, known := self.index.Lookup(key)
 
-	if err != nil {
-		log.Print("Non fatal error checking if object is cached %v", err)
+	if !known {
+		object, err := self.config.Store.Stat(key)
+
+		if err != nil {
+			log.Printf("Non fatal error checking if object is cached %v", err)
+		} else {
+			bucketKeyExists = object != nil
+			self.index.Set(key, bucketKeyExists)
+		}
 	}
 
 	if bucketKeyExists {
-		redirectUrl := self.config.Bucket.URL(key)
-		log.Printf("Cache hit redirect %s", redirectUrl)
-		http.Redirect(res, req, redirectUrl, 302)
+		self.accessed.Touch(key)
+		self.config.Store.Serve(key, res, req)
 		return true
 	}
 
 	return false
 }
 
-func (self *Routes) pullFromSource(
-	key string,
-	lock *chan bool,
-	req *http.Request,
-) {
-	// When we complete serving this free the lock...
-	defer self.requests.Complete(key, lock)
-	uploadStartTime := time.Now()
+// Issue a request to the source for the object the client requested. Parent
+// proxies are asked first and then origins are tried in order until one
+// responds without a server error.
+func (self *Routes) fetchSource(req *http.Request) (*http.Response, *url.URL, error) {
+	// Nearby caches which already have the object beat the origins...
+	if parentResp, parentURL := self.fetchParent(req); parentResp != nil {
+		return parentResp, parentURL, nil
+	}
+
+	var lastResp *http.Response
+	var lastURL *url.URL
+	var lastErr error
+
+	for _, origin := range self.origins.Ordered() {
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+
+		lastResp, lastURL, lastErr = self.fetchOrigin(origin, req)
+		if lastErr != nil {
+			self.origins.Failure(origin)
+			self.metrics.Send(self.metricsFactory.SourceError(origin.URL.Host, lastErr.Error()))
+			continue
+		}
+
+		if lastResp.StatusCode >= 500 {
+			self.origins.Failure(origin)
+			self.metrics.Send(self.metricsFactory.SourceError(origin.URL.Host, lastResp.Status))
+			continue
+		}
+
+		self.origins.Success(origin)
+		return lastResp, lastURL, nil
+	}
+
+	// Everything failed hand back whatever the last origin said...
+	return lastResp, lastURL, lastErr
+}
 
-	// Copy method and body over to the proxy request.
-	sourceURL := self.constructSourceUrl(req.URL)
+func (self *Routes) fetchOrigin(origin *origin, req *http.Request) (*http.Response, *url.URL, error) {
+	sourceURL := self.constructSourceUrl(origin, req.URL)
 	log.Printf("Proxying %s -> %s", req.URL, &sourceURL)
 
-	proxyReq, err := http.NewRequest(req.Method, sourceURL.String(), req.Body)
+	// We always want the full object from the source regardless of what
+	// (or how much) the client asked for.
+	proxyReq, err := http.NewRequest("GET", sourceURL.String(), nil)
 	// If we fail to create a request notify the client.
 	if err != nil {
 		log.Printf("Failed to generate proxy request: %s", err)
-		return
+		return nil, nil, err
 	}
 
 	// Copy all headers over to the proxy request.
 	for key, _ := range req.Header {
-		// Do not forward connection!
-		if key == "Connection" || key == "Host" {
+		// Do not forward connection (or anything which would result in a partial
+		// response)!
+		if key == "Connection" || key == "Host" || partialRequestHeaders[key] {
 			continue
 		}
 		proxyReq.Header.Set(key, req.Header.Get(key))
@@ -104,11 +266,13 @@ func (self *Routes) pullFromSource(
 		proxyReq.Header.Set("Accept-Encoding", "gzip, deflate")
 	}
 
+	signSourceRequest(self.config, proxyReq)
+
 	// Issue the proxy request...
 	proxyResp, err := httpClient.Do(proxyReq)
 	if err != nil {
 		log.Printf("Failed to fetch from source: %v", err)
-		return
+		return nil, nil, err
 	}
 
 	// Map the headers from the proxy back into our proxyResponse
@@ -116,64 +280,321 @@ func (self *Routes) pullFromSource(
 		log.Printf("Response header %s = %s", key, proxyResp.Header.Get(key))
 	}
 
-	// If the proxy returns a successful status code replicate!
-	if proxyResp.StatusCode == 200 {
-		contentLengthInt, err := strconv.Atoi(proxyResp.Header.Get("Content-Length"))
+	return proxyResp, &sourceURL, nil
+}
+
+// Upload the body of a successful source response into the cache bucket.
+func (self *Routes) uploadToCache(
+	key string,
+	sourceURL *url.URL,
+	proxyResp *http.Response,
+	body io.Reader,
+	contentLength int64,
+) error {
+	uploadStartTime := time.Now()
+
+	// Checksum everything as it goes by so we can check what landed in the
+	// bucket is what the source sent...
+	verifier := newContentVerifier(proxyResp.Header, self.config.VerifySHA256)
+	body = io.TeeReader(body, verifier)
+
+	// Keep a copy on local disk as the bytes go by...
+	var diskWriter *diskCacheWriter
+	if self.config.DiskCache != nil {
+		var err error
+		diskWriter, err = self.config.DiskCache.Writer(
+			self.diskKey(key),
+			passthroughHeaders(self.config.PassthroughHeaders, proxyResp.Header),
+			contentLength,
+		)
+		if err != nil {
+			log.Printf("Non fatal error creating disk cache entry for %s %v", key, err)
+		}
+		if diskWriter != nil {
+			body = io.TeeReader(body, diskWriter)
+		}
+	}
+
+	headers := objectHeaders(self.config, sourceURL.String(), proxyResp.Header)
+
+	// Have s3 reject the upload outright if it does not match the source.
+	if contentMD5 := verifier.ContentMD5(); contentMD5 != "" {
+		headers["Content-MD5"] = []string{contentMD5}
+	}
+
+	err := self.config.Store.Put(key, body, contentLength, headers)
+
+	if err == nil {
+		err = verifier.Verify(contentLength)
 		if err != nil {
-			log.Printf("Invalid content length in source object...")
-			return
+			self.removeCorruptObject(key, err)
 		}
+	}
 
-		var contentLength int64
-		contentLength = int64(contentLengthInt)
+	if diskWriter != nil {
+		if err != nil {
+			diskWriter.Abort()
+		} else if diskErr := diskWriter.Commit(); diskErr != nil {
+			log.Printf("Non fatal error writing %s to disk cache %v", key, diskErr)
+		}
+	}
 
-		err = self.config.Bucket.PutReaderHeader(
+	if err != nil {
+		self.index.Remove(key)
+		self.metrics.Send(self.metricsFactory.CacheUploadError(
+			time.Now().Sub(uploadStartTime),
 			key,
-			proxyResp.Body,
 			contentLength,
-			map[string][]string{
-				// Content Type is important to proxy...
-				"Content-Type": {proxyResp.Header.Get("Content-Type")},
-				"Content-Encoding": {proxyResp.Header.Get("Content-Encoding")},
-				// The proxy is intended to be shorter lived then the source so reduced
-				// reduced is ideal...
-				"x-amz-storage-class": {"REDUCED_REDUNDANCY"},
-				// Extra meta data about where/how this objects exists
-				"x-amz-meta-source": {sourceURL.String()},
-			},
-			s3.PublicRead,
-		)
+			sourceURL.Host,
+			err,
+		))
+	} else {
+		self.index.Set(key, true)
+		self.accessed.Touch(key)
+		if self.config.RevalidateAfter > 0 {
+			self.validated.Set(key, true, self.config.RevalidateAfter)
+		}
+		self.metrics.Send(self.metricsFactory.CacheUpload(
+			time.Now().Sub(uploadStartTime),
+			contentLength,
+			sourceURL.Host,
+		))
+	}
+	return err
+}
 
-		if err != nil {
-			self.metrics.Send(self.metricsFactory.CacheUploadError(
-				time.Now().Sub(uploadStartTime),
-				key,
-				contentLength,
-				err,
-			))
-		} else {
-			self.metrics.Send(self.metricsFactory.CacheUpload(
-				time.Now().Sub(uploadStartTime),
-				contentLength,
-			))
+// Remove an object which does not match what the source sent us.
+func (self *Routes) removeCorruptObject(key string, verifyErr error) {
+	log.Printf("Verification of %s failed removing cached copy %v", key, verifyErr)
+	self.metrics.Send(self.metricsFactory.CacheVerifyError(key, verifyErr))
+
+	err := self.config.Store.Delete(key)
+	if err != nil {
+		log.Printf("Failed to remove corrupt object %s %v", key, err)
+	}
+}
+
+func (self *Routes) pullFromSource(
+	key string,
+	lock *chan bool,
+	lease *fillLease,
+	req *http.Request,
+) {
+	// When we complete serving this free the lock...
+	defer self.requests.Complete(key, lock)
+	defer lease.Release()
+
+	proxyResp, sourceURL, err := self.fetchSource(req)
+	if err != nil {
+		return
+	}
+	defer proxyResp.Body.Close()
+
+	// If the proxy returns a successful status code replicate!
+	if proxyResp.StatusCode == 200 {
+		var body io.Reader = proxyResp.Body
+		contentLength := proxyResp.ContentLength
+
+		// Sources which do not send a length (chunked responses) are spooled to
+		// disk first since the upload needs to know the length up front.
+		if contentLength < 0 {
+			spool, err := self.spoolSource(key, proxyResp.Body)
+			if err != nil {
+				log.Printf("Cannot cache %s from source %v", key, err)
+				return
+			}
+			defer spool.Close()
+			body, contentLength = spool.file, spool.size
 		}
+
+		self.uploadToCache(key, sourceURL, proxyResp, body, contentLength)
 	} else {
-		// just redirect the user directly to the source...
-		proxyResp.Body.Close()
+		self.rememberSourceFailure(key, proxyResp.StatusCode)
 	}
+	// Otherwise the waiters will just redirect the user directly to the source...
 }
 
-// Wait for another request to complete the pull/cache or timeout and redirect
-// to the source...
-func (self *Routes) waitForSourcePull(
+// Copy a source body of unknown length into a spool file.
+func (self *Routes) spoolSource(key string, body io.Reader) (*spoolFile, error) {
+	if self.config.MaxSpoolSize <= 0 {
+		return nil, fmt.Errorf("Invalid content length in source object")
+	}
+
+	spool, err := newSpoolFile(self.config.MaxSpoolSize)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(spool, body)
+	if err == nil {
+		err = spool.Rewind()
+	}
+
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	log.Printf("Spooled %s (%d bytes) from source", key, spool.size)
+	return spool, nil
+}
+
+// Begin uploading a source body into the cache which is written to the
+// returned writer. The returned function must be called with the result of
+// copying the body and returns once the upload is complete.
+func (self *Routes) startCacheUpload(
+	key string,
+	sourceURL *url.URL,
+	proxyResp *http.Response,
+) (io.Writer, func(error)) {
+	// Sources which do not send a length are spooled and uploaded afterwards.
+	if proxyResp.ContentLength < 0 {
+		spool, err := newSpoolFile(self.config.MaxSpoolSize)
+		if err != nil {
+			log.Printf("Cannot spool %s from source %v", key, err)
+			return ioutil.Discard, func(error) {}
+		}
+
+		return spool, func(copyErr error) {
+			defer spool.Close()
+			if copyErr != nil {
+				return
+			}
+
+			err := spool.Rewind()
+			if err != nil {
+				log.Printf("Cannot cache %s from source %v", key, err)
+				return
+			}
+			self.uploadToCache(key, sourceURL, proxyResp, spool.file, spool.size)
+		}
+	}
+
+	cacheReader, cacheWriter := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := self.uploadToCache(key, sourceURL, proxyResp, cacheReader, proxyResp.ContentLength)
+		// Unblock the writer if the upload gave up before reading everything.
+		cacheReader.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	return cacheWriter, func(copyErr error) {
+		cacheWriter.CloseWithError(copyErr)
+		<-uploaded
+	}
+}
+
+// Stream the source response to the client while uploading the same bytes
+// into the cache bucket. Other requests for the same key wait on the lock as
+// they would for `pullFromSource`.
+func (self *Routes) teeFromSource(
 	key string,
 	lock *chan bool,
+	lease *fillLease,
 	res http.ResponseWriter,
 	req *http.Request,
 ) {
+	// When we complete serving this (or the upload is done) free the lock...
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			lease.Release()
+			self.requests.Complete(key, lock)
+		}
+	}
+	defer release()
 
-	now := time.Now()
-	wait := MAX_SOURCE_PULL_WAIT
+	proxyResp, sourceURL, err := self.fetchSource(req)
+	if err != nil {
+		self.redirectToSource(res, req)
+		self.metrics.Send(self.metricsFactory.CacheErrorRedirect())
+		return
+	}
+	defer proxyResp.Body.Close()
+
+	cacheable := proxyResp.ContentLength >= 0 || self.config.MaxSpoolSize > 0
+	if proxyResp.StatusCode != 200 || !cacheable {
+		// Nothing we can cache so let the client deal with the source directly.
+		self.rememberSourceFailure(key, proxyResp.StatusCode)
+		self.redirectToSource(res, req)
+		return
+	}
+
+	// Ranges we cannot slice out of the stream (unknown length, multiple
+	// ranges, If-Range) are served from the cache once the upload is done.
+	rangeHeader := req.Header.Get("Range")
+	start, length, satisfiable := int64(0), proxyResp.ContentLength, true
+	if rangeHeader != "" {
+		start, length, satisfiable = parseByteRange(rangeHeader, proxyResp.ContentLength)
+		satisfiable = satisfiable && req.Header.Get("If-Range") == ""
+	}
+
+	if !satisfiable {
+		cacheWriter, finishUpload := self.startCacheUpload(key, sourceURL, proxyResp)
+		_, err = io.Copy(cacheWriter, proxyResp.Body)
+		finishUpload(err)
+
+		if !self.serveFromDisk(key, res, req) && !self.attemptCacheRedirect(key, res, req) {
+			self.redirectToSource(res, req)
+		}
+		return
+	}
+
+	for name, values := range proxyResp.Header {
+		res.Header()[name] = values
+	}
+
+	var client io.Writer = res
+	if rangeHeader != "" {
+		res.Header().Set("Content-Range", fmt.Sprintf(
+			"bytes %d-%d/%d", start, start+length-1, proxyResp.ContentLength,
+		))
+		res.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		res.WriteHeader(http.StatusPartialContent)
+		client = &rangeWriter{writer: res, start: start, length: length}
+	} else {
+		res.WriteHeader(proxyResp.StatusCode)
+	}
+	http.NewResponseController(res).Flush()
+
+	// The client is written to on the side so it cannot slow down the fill
+	// (cutting its connection short if it falls too far behind).
+	laggingClient := newLaggingWriter(client, self.config.TeeMaxClientLag, func() {
+		http.NewResponseController(res).SetWriteDeadline(time.Now())
+	})
+
+	cacheWriter, finishUpload := self.startCacheUpload(key, sourceURL, proxyResp)
+	writer := &teeWriter{cache: cacheWriter, client: laggingClient}
+	_, err = io.Copy(writer, proxyResp.Body)
+
+	if err != nil {
+		log.Printf("Error streaming %s from source %v", key, err)
+	}
+	if writer.cacheErr != nil {
+		log.Printf("Stopped caching %s while streaming %v", key, writer.cacheErr)
+	}
+
+	// A cache write error must also fail the upload (the spool is incomplete).
+	if err == nil {
+		err = writer.cacheErr
+	}
+
+	// Hold the lock until the upload is done so waiters can be redirected to it
+	// (but not while the client catches up).
+	finishUpload(err)
+	release()
+
+	clientErr := laggingClient.Close()
+	if clientErr != nil {
+		log.Printf("Client went away while streaming %s %v", key, clientErr)
+	}
+}
+
+// How long the request may wait on a cache fill.
+func (self *Routes) maxWait(req *http.Request) time.Duration {
+	wait := self.config.MaxSourcePullWait
 
 	// Primarily for testing we allow setting how long this request should wait
 	// (it cannot be configured to wait for more then the default value though!)
@@ -194,12 +615,30 @@ func (self *Routes) waitForSourcePull(
 			}
 		}
 	}
+	return wait
+}
+
+// Wait for another request to complete the pull/cache or timeout and redirect
+// to the source...
+func (self *Routes) waitForSourcePull(
+	key string,
+	lock *chan bool,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+
+	self.requests.AddWaiter()
+	defer self.requests.RemoveWaiter()
+
+	now := time.Now()
+	wait := self.maxWait(req)
 
 	select {
 	case <-*lock:
 		waited := time.Now().Sub(now)
 		log.Printf("%s ready waited for %v", key, waited)
-		redirected := self.attemptCacheRedirect(key, res, req)
+		redirected := self.serveFromDisk(key, res, req) ||
+			self.attemptCacheRedirect(key, res, req)
 		if !redirected {
 			self.metrics.Send(self.metricsFactory.WaitedForUploadMiss(waited))
 			log.Printf("Successfully watied for %s but no cache was created", key)
@@ -217,15 +656,54 @@ func (self *Routes) waitForSourcePull(
 
 // Routes implements the `http.Handler` interface
 func (self Routes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	// Requests which went through us before are looping between parents...
+	if self.seenByUs(req) {
+		log.Printf("Loop detected for %s via %s", req.URL, req.Header.Get(PROXY_VIA_HEADER))
+		http.Error(res, "Loop detected", 508)
+		return
+	}
+
 	// Check if we should directly redirect to s3 first...
 	key := self.constructKeyName(req.URL)
 
+	// Cached copies which changed at the source are treated as a miss (and
+	// replaced)...
+	stale := self.isStale(key, req)
+
+	// With a disk cache everything goes to the peer owning the key (so it is
+	// only kept on one disk)...
+	if self.config.DiskCache != nil && self.forwardToPeer(key, res, req) {
+		return
+	}
+
+	// Hot objects may be served directly from this host...
+	if !stale && self.serveFromDisk(key, res, req) {
+		self.metrics.Send(self.metricsFactory.DiskCacheHit())
+		return
+	}
+
 	// Attempt the initial cache hit...
-	if self.attemptCacheRedirect(key, res, req) {
+	if !stale && self.attemptCacheRedirect(key, res, req) {
 		self.metrics.Send(self.metricsFactory.CacheHit())
 		return
 	}
 
+	// Child proxies only want what we already have...
+	if onlyIfCached(req) {
+		http.Error(res, "Not cached", http.StatusGatewayTimeout)
+		return
+	}
+
+	// Don't bother the source with requests we know will fail...
+	if self.attemptNegativeCacheHit(key, res, req) {
+		return
+	}
+
+	// ...otherwise just the misses so only the owner fills it.
+	if self.forwardToPeer(key, res, req) {
+		return
+	}
+
 	// Mutex around who can do the source pulling and when...
 	lock := self.requests.Get(key)
 	if lock != nil {
@@ -247,7 +725,21 @@ func (self Routes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Another proxy sharing the store may already be filling it...
+	lease, claimed := self.claimFill(key)
+	if !claimed {
+		self.waitForRemoteFill(key, lock, res, req)
+		return
+	}
+
+	// In tee mode this request streams from the source itself rather then
+	// waiting on the upload.
+	if self.config.Tee && req.Method == "GET" {
+		self.teeFromSource(key, lock, lease, res, req)
+		return
+	}
+
 	// Pull from the source !
-	go self.pullFromSource(key, lock, req)
+	go self.pullFromSource(key, lock, lease, req)
 	self.waitForSourcePull(key, lock, res, req)
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry in the routing table loaded from the --routes file. Anything not set
+// is inherited from the command line options.
+type RouteConfig struct {
+	// Requests for this host (any host when empty)...
+	Host string `json:"host"`
+	// ...under this path prefix are routed to this entry. The prefix is
+	// stripped before the request is sent to the source or cached.
+	Path string `json:"path"`
+
+	Sources []string `json:"sources"`
+	// Parent proxies (see --parents).
+	Parents []string `json:"parents"`
+	// Region to sign source requests for (see --source-region).
+	SourceRegion string `json:"sourceRegion"`
+
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	// Local directory to cache into rather then a bucket.
+	StoreDir string `json:"storeDir"`
+	Prefix   string `json:"prefix"`
+
+	MultipartThreshold int64 `json:"multipartThreshold"`
+	MultipartPartSize  int64 `json:"multipartPartSize"`
+	Tee                *bool `json:"tee"`
+
+	Private         *bool  `json:"private"`
+	SignedURLExpiry string `json:"signedUrlExpiry"`
+
+	StorageClass string `json:"storageClass"`
+	ACL          string `json:"acl"`
+	SSE          string `json:"sse"`
+	SSEKMSKeyID  string `json:"sseKmsKeyId"`
+	// Merged with (and wins over) the default metadata.
+	Metadata map[string]string `json:"metadata"`
+	// Replaces (rather then merges with) the default passthrough headers.
+	PassthroughHeaders []string `json:"passthroughHeaders"`
+
+	FillLockLease string `json:"fillLockLease"`
+
+	ExpireAfter   string `json:"expireAfter"`
+	MaxStoreSize  int64  `json:"maxStoreSize"`
+	LifecycleDays int    `json:"lifecycleDays"`
+}
+
+func LoadRouteConfigs(filename string) ([]RouteConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []RouteConfig{}
+	err = json.Unmarshal(content, &routes)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse routes file %s: %v", filename, err)
+	}
+
+	return routes, nil
+}
+
+// Build the ProxyConfig for this route on top of the given defaults.
+func (self *RouteConfig) ProxyConfig(defaults *ProxyConfig, auth aws.Auth) (*ProxyConfig, error) {
+	config := *defaults
+
+	if len(self.Sources) > 0 {
+		config.Sources = []*url.URL{}
+		for _, source := range self.Sources {
+			sourceURL, err := url.Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing source of route %s: %v", self.Path, err)
+			}
+			config.Sources = append(config.Sources, sourceURL)
+		}
+	}
+
+	if self.Parents != nil {
+		config.Parents = []*url.URL{}
+		for _, parent := range self.Parents {
+			parentURL, err := url.Parse(parent)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing parent of route %s: %v", self.Path, err)
+			}
+			config.Parents = append(config.Parents, parentURL)
+		}
+	}
+
+	if self.SourceRegion != "" {
+		config.SourceRegion = self.SourceRegion
+	}
+	if self.Prefix != "" {
+		config.Prefix = self.Prefix
+	}
+	if self.MultipartThreshold != 0 {
+		config.MultipartThreshold = self.MultipartThreshold
+	}
+	if self.MultipartPartSize != 0 {
+		config.MultipartPartSize = self.MultipartPartSize
+	}
+	if self.Tee != nil {
+		config.Tee = *self.Tee
+	}
+	if self.Private != nil {
+		config.Private = *self.Private
+	}
+	if self.SignedURLExpiry != "" {
+		expiry, err := time.ParseDuration(self.SignedURLExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse signed url expiry of route %s: %v", self.Path, err)
+		}
+		config.SignedURLExpiry = expiry
+	}
+	if self.StorageClass != "" {
+		config.StorageClass = self.StorageClass
+	}
+	if self.ACL != "" {
+		config.ACL = self.ACL
+	}
+	if self.SSE != "" {
+		// The default key belongs to the default algorithm...
+		config.SSE = self.SSE
+		config.SSEKMSKeyID = ""
+	}
+	if self.SSEKMSKeyID != "" {
+		config.SSEKMSKeyID = self.SSEKMSKeyID
+	}
+	if len(self.Metadata) > 0 {
+		config.Metadata = map[string]string{}
+		for name, value := range defaults.Metadata {
+			config.Metadata[name] = value
+		}
+		for name, value := range self.Metadata {
+			config.Metadata[name] = value
+		}
+	}
+
+	if self.PassthroughHeaders != nil {
+		config.PassthroughHeaders = self.PassthroughHeaders
+	}
+	if self.FillLockLease != "" {
+		lease, err := time.ParseDuration(self.FillLockLease)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse fill lock lease of route %s: %v", self.Path, err)
+		}
+		config.FillLockLease = lease
+	}
+	if self.ExpireAfter != "" {
+		expireAfter, err := time.ParseDuration(self.ExpireAfter)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse expire after of route %s: %v", self.Path, err)
+		}
+		config.ExpireAfter = expireAfter
+	}
+	if self.MaxStoreSize != 0 {
+		config.MaxStoreSize = self.MaxStoreSize
+	}
+	if self.LifecycleDays != 0 {
+		config.LifecycleDays = self.LifecycleDays
+	}
+
+	err := validateObjectOptions(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid storage options of route %s: %v", self.Path, err)
+	}
+
+	if self.StoreDir != "" {
+		store, err := NewFileStore(self.StoreDir)
+		if err != nil {
+			return nil, err
+		}
+		config.Store = store
+	} else if self.Bucket != "" || self.Region != "" {
+		if self.Bucket == "" || self.Region == "" {
+			return nil, fmt.Errorf("Route %s must set both region and bucket", self.Path)
+		}
+
+		region, err := strToRegion(self.Region, config.S3Endpoint, config.S3PathStyle)
+		if err != nil {
+			return nil, err
+		}
+		bucket := s3.New(auth, *region).Bucket(self.Bucket)
+		config.Store = configuredS3Store(bucket, &config)
+	} else if s3Store, ok := config.Store.(*S3Store); ok {
+		// Same bucket but possibly different storage options...
+		config.Store = configuredS3Store(s3Store.Bucket, &config)
+	}
+
+	if len(config.Sources) == 0 {
+		return nil, fmt.Errorf("Route %s has no sources", self.Path)
+	}
+	if config.Private && config.SignedURLExpiry <= 0 {
+		return nil, fmt.Errorf("Signed url expiry of route %s must be positive", self.Path)
+	}
+	if config.Store == nil {
+		return nil, fmt.Errorf("Route %s has no bucket or store dir", self.Path)
+	}
+	if config.MultipartThreshold > MAX_SINGLE_PUT_SIZE {
+		return nil, fmt.Errorf("Multipart threshold of route %s cannot exceed %d bytes", self.Path, MAX_SINGLE_PUT_SIZE)
+	}
+	if config.MultipartPartSize < MIN_MULTIPART_PART_SIZE {
+		return nil, fmt.Errorf("Multipart part size of route %s must be at least %d bytes", self.Path, MIN_MULTIPART_PART_SIZE)
+	}
+
+	return &config, nil
+}
+
+// Routes sharing a store must cache under prefixes which do not overlap. The
+// route path is stripped before the key is built so /a/foo and /b/foo would
+// otherwise both be cached as <prefix>/foo (and served to either route).
+func checkRouteKeys(loaded []loadedRoute) error {
+	for i, route := range loaded {
+		for _, other := range loaded[:i] {
+			store := route.routes.config.Store.Name()
+			if store != other.routes.config.Store.Name() {
+				continue
+			}
+
+			prefix := route.routes.storePrefix()
+			otherPrefix := other.routes.storePrefix()
+			if strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix) {
+				return fmt.Errorf(
+					"Routes host=%s path=%s and host=%s path=%s share keys in store %s (give them prefixes which do not overlap)",
+					other.host, other.path, route.host, route.path, store,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+type route struct {
+	host    string
+	path    string
+	handler http.Handler
+}
+
+type routesByPriority []route
+
+func (self routesByPriority) Len() int      { return len(self) }
+func (self routesByPriority) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self routesByPriority) Less(i, j int) bool {
+	if len(self[i].path) != len(self[j].path) {
+		return len(self[i].path) > len(self[j].path)
+	}
+	return self[i].host != "" && self[j].host == ""
+}
+
+// Dispatches requests to the handler of the most specific matching route
+// (longest path, then routes with a host over those without).
+type Router struct {
+	routes []route
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func cleanRoutePath(routePath string) string {
+	return path.Clean("/" + routePath)
+}
+
+func (self *Router) Add(host, routePath string, handler http.Handler) {
+	self.routes = append(self.routes, route{
+		host:    strings.ToLower(host),
+		path:    cleanRoutePath(routePath),
+		handler: handler,
+	})
+
+	sort.Stable(routesByPriority(self.routes))
+}
+
+// Find the route for the request along with the path relative to the route.
+func (self *Router) match(req *http.Request) (*route, string) {
+	host := strings.ToLower(req.Host)
+	if colon := strings.LastIndex(host, ":"); colon != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:colon]
+	}
+
+	for i := range self.routes {
+		route := &self.routes[i]
+		if route.host != "" && route.host != host {
+			continue
+		}
+
+		if route.path == "/" {
+			return route, req.URL.Path
+		}
+
+		// Only match on whole path segments (/foo should not match /foobar).
+		if req.URL.Path == route.path || strings.HasPrefix(req.URL.Path, route.path+"/") {
+			return route, "/" + strings.TrimPrefix(req.URL.Path[len(route.path):], "/")
+		}
+	}
+
+	return nil, ""
+}
+
+func (self *Router) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	route, relativePath := self.match(req)
+	if route == nil {
+		http.NotFound(res, req)
+		return
+	}
+
+	if relativePath != req.URL.Path {
+		routedReq := *req
+		routedURL := *req.URL
+		routedURL.Path = relativePath
+		routedURL.RawPath = ""
+		routedReq.URL = &routedURL
+		req = &routedReq
+	}
+
+	route.handler.ServeHTTP(res, req)
+}
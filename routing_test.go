@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type pathRecorder struct {
+	name  string
+	paths *[]string
+}
+
+func (self pathRecorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	*self.paths = append(*self.paths, self.name+" "+req.URL.Path)
+}
+
+func TestRouterMatchesMostSpecificRoute(t *testing.T) {
+	paths := []string{}
+	router := NewRouter()
+	router.Add("", "/", pathRecorder{"default", &paths})
+	router.Add("", "/tc", pathRecorder{"tc", &paths})
+	router.Add("", "/tc/private/", pathRecorder{"private", &paths})
+	router.Add("artifacts.example.com", "/", pathRecorder{"host", &paths})
+
+	requests := []struct {
+		host string
+		path string
+	}{
+		{"localhost", "/foo/bar"},
+		{"localhost", "/tc/foo"},
+		{"localhost", "/tcfoo"},
+		{"localhost", "/tc/private/foo"},
+		{"artifacts.example.com:8080", "/foo"},
+		{"artifacts.example.com", "/tc/foo"},
+	}
+
+	for _, request := range requests {
+		req, _ := http.NewRequest("GET", "http://"+request.host+request.path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := []string{
+		"default /foo/bar",
+		"tc /foo",
+		"default /tcfoo",
+		"private /foo",
+		"host /foo",
+		"tc /foo",
+	}
+
+	if len(paths) != len(expected) {
+		t.Fatalf("Unexpected routes %v", paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Fatalf("Expected %s got %s", expected[i], paths[i])
+		}
+	}
+}
+
+func TestRouterWithoutMatch(t *testing.T) {
+	router := NewRouter()
+	router.Add("", "/tc", pathRecorder{"tc", &[]string{}})
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	if res.Code != 404 {
+		t.Fatalf("Expected 404 got %d", res.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4 of s3 requests and presigned urls. goamz has a
+// V4Signer but it signs paths the way Go escapes them (S3 expects everything
+// but the unreserved characters to be percent encoded), escapes queries as
+// forms and reads whole bodies into memory to hash them.
+const (
+	SIGV4_ALGORITHM   = "AWS4-HMAC-SHA256"
+	SIGV4_TIME_FORMAT = "20060102T150405Z"
+	SIGV4_DATE_FORMAT = "20060102"
+
+	// Payload hash of requests which stream their body without hashing it.
+	UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+
+	// Longest S3 accepts for a presigned url.
+	MAX_PRESIGNED_URL_EXPIRY = 7 * 24 * time.Hour
+)
+
+// Time requests are signed at (replaced by tests).
+var signingTime = time.Now
+
+type sigV4Signer struct {
+	// A copy since Token refreshes expired instance credentials in place
+	// (rather then racing other requests on the shared config).
+	auth    aws.Auth
+	region  string
+	service string
+}
+
+func newS3Signer(auth aws.Auth, region string) *sigV4Signer {
+	return &sigV4Signer{auth: auth, region: region, service: "s3"}
+}
+
+// Percent encode everything but the unreserved characters (and slashes of
+// paths).
+func sigV4Escape(value string, path bool) string {
+	escaped := bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func sigV4Path(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return sigV4Escape(u.Path, true)
+}
+
+// Query parameters sorted by name (then value) and escaped.
+func sigV4Query(query url.Values) string {
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, sigV4Escape(name, false)+"="+sigV4Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (self *sigV4Signer) scope(now time.Time) string {
+	return now.Format(SIGV4_DATE_FORMAT) + "/" + self.region + "/" + self.service + "/aws4_request"
+}
+
+func (self *sigV4Signer) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		SIGV4_ALGORITHM,
+		now.Format(SIGV4_TIME_FORMAT),
+		self.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+self.auth.SecretKey), now.Format(SIGV4_DATE_FORMAT))
+	key = hmacSHA256(key, self.region)
+	key = hmacSHA256(key, self.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Sign the request (and every header it has so far) with the given payload
+// hash. The path is sent escaped the same way it is signed.
+func (self *sigV4Signer) Sign(req *http.Request, payloadHash string) {
+	now := signingTime().UTC()
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", now.Format(SIGV4_TIME_FORMAT))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token := self.auth.Token(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	names := []string{"host"}
+	for name, headerValues := range req.Header {
+		name = strings.ToLower(name)
+		if name == "host" {
+			continue
+		}
+		trimmed := []string{}
+		for _, value := range headerValues {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		values[name] = strings.Join(trimmed, ",")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, values[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := sigV4Path(req.URL)
+	req.URL.RawPath = path
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		sigV4Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		SIGV4_ALGORITHM, self.auth.AccessKey, self.scope(now), signedHeaders,
+		self.signature(now, canonicalRequest),
+	))
+}
+
+// Url anyone can GET for as long as expires (at most a week).
+func (self *sigV4Signer) Presign(rawURL string, expires time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if expires > MAX_PRESIGNED_URL_EXPIRY {
+		expires = MAX_PRESIGNED_URL_EXPIRY
+	}
+
+	now := signingTime().UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", SIGV4_ALGORITHM)
+	query.Set("X-Amz-Credential", self.auth.AccessKey+"/"+self.scope(now))
+	query.Set("X-Amz-Date", now.Format(SIGV4_TIME_FORMAT))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if token := self.auth.Token(); token != "" {
+		query.Set("X-Amz-Security-Token", token)
+	}
+
+	path := sigV4Path(u)
+	canonicalQuery := sigV4Query(query)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		UNSIGNED_PAYLOAD,
+	}, "\n")
+
+	u.RawPath = path
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + self.signature(now, canonicalRequest)
+	return u.String(), nil
+}
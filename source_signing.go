@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Hex sha256 of an empty body (source requests never have one).
+const EMPTY_PAYLOAD_SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Sign the request with our own credentials using AWS signature version 4
+// (when the config has a source region). Any credentials or amz headers the
+// client sent along are dropped first.
+func signSourceRequest(config *ProxyConfig, req *http.Request) {
+	if config.SourceRegion == "" {
+		return
+	}
+
+	req.Header.Del("Authorization")
+	for name := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			req.Header.Del(name)
+		}
+	}
+
+	newS3Signer(config.SourceAuth, config.SourceRegion).Sign(req, EMPTY_PAYLOAD_SHA256)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Temporary file holding a source body which was sent without a length
+// (chunked responses) so we can find the length before uploading it.
+type spoolFile struct {
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+func newSpoolFile(maxSize int64) (*spoolFile, error) {
+	file, err := ioutil.TempFile("", "s3-copy-proxy-spool-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &spoolFile{
+		file:    file,
+		maxSize: maxSize,
+	}, nil
+}
+
+func (self *spoolFile) Write(p []byte) (int, error) {
+	if self.size+int64(len(p)) > self.maxSize {
+		return 0, fmt.Errorf("Source body exceeds max spool size of %d bytes", self.maxSize)
+	}
+
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+// Seek back to the start of the file so it can be read.
+func (self *spoolFile) Rewind() error {
+	_, err := self.file.Seek(0, 0)
+	return err
+}
+
+// Close and remove the underlying file.
+func (self *spoolFile) Close() error {
+	err := self.file.Close()
+	os.Remove(self.file.Name())
+	return err
+}
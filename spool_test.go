@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpoolFile(t *testing.T) {
+	spool, err := newSpoolFile(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.Copy(spool, strings.NewReader("xfoobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = spool.Rewind()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadAll(spool.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "xfoobar" || spool.size != 7 {
+		t.Fatalf("Unexpected spool content %s (%d)", content, spool.size)
+	}
+
+	spool.Close()
+	if _, err := os.Stat(spool.file.Name()); !os.IsNotExist(err) {
+		t.Fatal("Expected spool file to be removed")
+	}
+}
+
+func TestSpoolFileMaxSize(t *testing.T) {
+	spool, err := newSpoolFile(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	_, err = io.Copy(spool, strings.NewReader("xfoobar"))
+	if err == nil {
+		t.Fatal("Expected spooling more then the max size to fail")
+	}
+}
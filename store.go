@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/goamz/goamz/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Object in a CacheStore.
+type CacheObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Headers (and x-amz-meta-* metadata) the object was stored with. Only
+	// populated by Stat.
+	Header http.Header
+}
+
+// Somewhere cached objects are kept (the regional bucket, local disk, ...).
+// Implementations must be thread safe.
+type CacheStore interface {
+	// Name of the store (the bucket name for s3) used in logs and to tell
+	// stores apart.
+	Name() string
+
+	// Returns nil (and no error) when the key is not in the store.
+	Stat(key string) (*CacheObject, error)
+
+	// Store the body under the key. Headers are the http headers and
+	// x-amz-meta-* metadata of the object. Stores must reject bodies which do
+	// not match contentLength or the Content-MD5 header (when given).
+	Put(key string, body io.Reader, contentLength int64, header http.Header) error
+
+	// Respond to the request with the object (either directly or with a
+	// redirect).
+	Serve(key string, res http.ResponseWriter, req *http.Request)
+
+	Delete(key string) error
+
+	// Delete many keys at once (missing keys are not an error).
+	DeleteMulti(keys []string) error
+
+	// Call fn for every object under the prefix until it returns false.
+	List(prefix string, fn func(object *CacheObject) bool) error
+}
+
+// CacheStore backed by an s3 bucket. Clients are redirected to the bucket for
+// cache hits.
+type S3Store struct {
+	Bucket *s3.Bucket
+
+	// Objects larger then this many bytes are uploaded using multipart uploads
+	// in parts of MultipartPartSize.
+	MultipartThreshold int64
+	MultipartPartSize  int64
+
+	// Objects are uploaded with this acl (public-read by default).
+	ACL s3.ACL
+	// When set clients are redirected to signed urls valid for this long
+	// rather then the public url of the object.
+	SignedURLExpiry time.Duration
+
+	// Objects are uploaded, checked and signed for with signature version 4
+	// (rather then by goamz with version 2) which S3 requires for kms
+	// encrypted objects.
+	SignatureV4 bool
+}
+
+func NewS3Store(bucket *s3.Bucket, multipartThreshold, multipartPartSize int64) *S3Store {
+	return &S3Store{
+		Bucket:             bucket,
+		MultipartThreshold: multipartThreshold,
+		MultipartPartSize:  multipartPartSize,
+		ACL:                s3.PublicRead,
+	}
+}
+
+// S3Store of the bucket with the storage options of the config.
+func configuredS3Store(bucket *s3.Bucket, config *ProxyConfig) *S3Store {
+	store := NewS3Store(bucket, config.MultipartThreshold, config.MultipartPartSize)
+	if config.Private {
+		store.ACL = s3.Private
+		store.SignedURLExpiry = config.SignedURLExpiry
+	}
+	if config.ACL != "" {
+		store.ACL = s3.ACL(config.ACL)
+	}
+	store.SignatureV4 = config.SSE == SSE_KMS
+	return store
+}
+
+func (self *S3Store) signer() *sigV4Signer {
+	return newS3Signer(self.Bucket.S3.Auth, self.Bucket.Region.Name)
+}
+
+func (self *S3Store) head(key string) (*http.Response, error) {
+	if !self.SignatureV4 {
+		return self.Bucket.Head(key, nil)
+	}
+
+	req, err := http.NewRequest("HEAD", self.Bucket.URL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	return doSignedBucketRequest(self.Bucket, req, nil)
+}
+
+// The body is streamed without hashing it first (UNSIGNED-PAYLOAD).
+func (self *S3Store) putSigned(key string, body io.Reader, contentLength int64, header http.Header) error {
+	req, err := http.NewRequest("PUT", self.Bucket.URL(key), ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = contentLength
+	if contentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	for name, values := range header {
+		if name = http.CanonicalHeaderKey(name); name != "Content-Length" {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("X-Amz-Acl", string(self.ACL))
+
+	resp, err := doBucketRequest(self.Bucket, req, UNSIGNED_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (self *S3Store) Name() string {
+	return self.Bucket.Name
+}
+
+func (self *S3Store) Stat(key string) (*CacheObject, error) {
+	resp, err := self.head(key)
+	if err != nil {
+		// We can treat a 403 or 404 as non existance (same as `Bucket.Exists`)
+		if s3Err, ok := err.(*s3.Error); ok && (s3Err.StatusCode == 403 || s3Err.StatusCode == 404) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	object := &CacheObject{
+		Key:    key,
+		Size:   resp.ContentLength,
+		Header: resp.Header,
+	}
+
+	lastModified, err := parseHTTPTime(resp.Header.Get("Last-Modified"))
+	if err == nil {
+		object.LastModified = lastModified
+	}
+
+	return object, nil
+}
+
+func (self *S3Store) Put(key string, body io.Reader, contentLength int64, header http.Header) error {
+	// Objects over the threshold (S3 will refuse anything over 5gb in a single
+	// PUT) are streamed up in parts instead.
+	if contentLength > self.MultipartThreshold {
+		return putMultipart(
+			self.Bucket,
+			key,
+			body,
+			contentLength,
+			self.MultipartPartSize,
+			header,
+			self.ACL,
+			self.SignatureV4,
+		)
+	}
+
+	if self.SignatureV4 {
+		return self.putSigned(key, body, contentLength, header)
+	}
+	return self.Bucket.PutReaderHeader(key, body, contentLength, header, self.ACL)
+}
+
+func (self *S3Store) Serve(key string, res http.ResponseWriter, req *http.Request) {
+	if self.SignedURLExpiry > 0 {
+		// Don't log the signature...
+		log.Printf("Cache hit signed redirect %s", self.Bucket.URL(key))
+		if !self.SignatureV4 {
+			http.Redirect(res, req, self.Bucket.SignedURL(key, time.Now().Add(self.SignedURLExpiry)), 302)
+			return
+		}
+		signedUrl, err := self.signer().Presign(self.Bucket.URL(key), self.SignedURLExpiry)
+		if err != nil {
+			http.Error(res, err.Error(), 500)
+			return
+		}
+		http.Redirect(res, req, signedUrl, 302)
+		return
+	}
+
+	redirectUrl := self.Bucket.URL(key)
+	log.Printf("Cache hit redirect %s", redirectUrl)
+	http.Redirect(res, req, redirectUrl, 302)
+}
+
+func (self *S3Store) Delete(key string) error {
+	return self.Bucket.Del(key)
+}
+
+// S3 deletes at most this many keys per request.
+const MAX_DELETE_MULTI_KEYS = 1000
+
+func (self *S3Store) DeleteMulti(keys []string) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > MAX_DELETE_MULTI_KEYS {
+			batch = batch[:MAX_DELETE_MULTI_KEYS]
+		}
+		keys = keys[len(batch):]
+
+		objects := s3.Delete{Quiet: true}
+		for _, key := range batch {
+			objects.Objects = append(objects.Objects, s3.Object{Key: key})
+		}
+		err := self.Bucket.DelMulti(objects)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *S3Store) List(prefix string, fn func(object *CacheObject) bool) error {
+	marker := ""
+	for {
+		list, err := self.Bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range list.Contents {
+			object := &CacheObject{
+				Key:  key.Key,
+				Size: key.Size,
+			}
+			// Listings use ISO 8601 rather then http dates...
+			lastModified, err := time.Parse(time.RFC3339Nano, key.LastModified)
+			if err == nil {
+				object.LastModified = lastModified
+			}
+
+			if !fn(object) {
+				return nil
+			}
+		}
+
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			return nil
+		}
+
+		// NextMarker is only returned when a delimiter is used...
+		marker = list.NextMarker
+		if marker == "" {
+			marker = list.Contents[len(list.Contents)-1].Key
+		}
+	}
+}
+
+// Send a request to the bucket signed with AWS signature version 4 (for the
+// few requests goamz has no way of making itself). Error responses are
+// returned as an `*s3.Error` the same as goamz would.
+func doSignedBucketRequest(bucket *s3.Bucket, req *http.Request, body []byte) (*http.Response, error) {
+	sha256Sum := sha256.Sum256(body)
+	return doBucketRequest(bucket, req, hex.EncodeToString(sha256Sum[:]))
+}
+
+// Same as doSignedBucketRequest for requests with the given payload hash
+// (UNSIGNED_PAYLOAD for bodies streamed without hashing them first).
+func doBucketRequest(bucket *s3.Bucket, req *http.Request, payloadHash string) (*http.Response, error) {
+	newS3Signer(bucket.S3.Auth, bucket.Region.Name).Sign(req, payloadHash)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		s3Err := &s3.Error{}
+		xml.Unmarshal(message, s3Err)
+		s3Err.StatusCode = resp.StatusCode
+		if s3Err.Message == "" {
+			s3Err.Message = strings.TrimSpace(string(message))
+		}
+		if s3Err.Message == "" {
+			s3Err.Message = resp.Status
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func putString(t *testing.T, store CacheStore, key, content string, header http.Header) {
+	err := store.Put(key, bytes.NewReader([]byte(content)), int64(len(content)), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Behaviour every CacheStore must have.
+func testCacheStore(t *testing.T, store CacheStore) {
+	object, err := store.Stat("production/a")
+	if err != nil || object != nil {
+		t.Fatalf("Expected missing object got %v %v", object, err)
+	}
+
+	header := http.Header{
+		"Content-Type":         {"text/plain"},
+		"x-amz-meta-source":    {"http://example.com/a"},
+		"Content-MD5":          {XFOO_CONTENT_MD5},
+		"x-amz-storage-class":  {"REDUCED_REDUNDANCY"},
+		"x-amz-meta-unrelated": {"foo"},
+	}
+	putString(t, store, "production/a", "xfoo", header)
+	putString(t, store, "production/b/c", "xfoo", http.Header{})
+	putString(t, store, "other/d", "xfoo", http.Header{})
+
+	object, err = store.Stat("production/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object == nil || object.Size != 4 || object.LastModified.IsZero() {
+		t.Fatalf("Unexpected object %v", object)
+	}
+	if object.Header.Get("x-amz-meta-source") != "http://example.com/a" {
+		t.Fatalf("Metadata not stored %v", object.Header)
+	}
+
+	keys := []string{}
+	err = store.List("production/", func(object *CacheObject) bool {
+		keys = append(keys, object.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "production/a" || keys[1] != "production/b/c" {
+		t.Fatalf("Unexpected listing %v", keys)
+	}
+
+	// Stops when asked to...
+	listed := 0
+	err = store.List("", func(object *CacheObject) bool {
+		listed++
+		return false
+	})
+	if err != nil || listed != 1 {
+		t.Fatalf("Expected listing to stop after one object got %d %v", listed, err)
+	}
+
+	err = store.Delete("production/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err = store.Stat("production/a")
+	if err != nil || object != nil {
+		t.Fatalf("Expected deleted object got %v %v", object, err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	server, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Quit()
+
+	region := aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           server.URL(),
+		S3LocationConstraint: true,
+	}
+	bucket := s3.New(aws.Auth{}, region).Bucket("bucket")
+	err = bucket.PutBucket(s3.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE)
+	testCacheStore(t, store)
+
+	putString(t, store, "hit", "xfoo", http.Header{})
+	req, _ := http.NewRequest("GET", "http://localhost/hit", nil)
+	res := httptest.NewRecorder()
+	store.Serve("hit", res, req)
+
+	if res.Code != 302 || res.Header().Get("Location") != bucket.URL("hit") {
+		t.Fatalf("Expected redirect to bucket got %d %s", res.Code, res.Header().Get("Location"))
+	}
+}
+
+func TestS3StoreDeleteMulti(t *testing.T) {
+	bucket, requests, cleanup := newRecordingBucket(t)
+	defer cleanup()
+
+	keys := []string{}
+	for i := 0; i < MAX_DELETE_MULTI_KEYS+1; i++ {
+		keys = append(keys, fmt.Sprintf("production/%d", i))
+	}
+
+	store := NewS3Store(bucket, MAX_SINGLE_PUT_SIZE, MIN_MULTIPART_PART_SIZE)
+	err := store.DeleteMulti(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("Expected the keys to be deleted in two batches got %d", len(*requests))
+	}
+	for _, req := range *requests {
+		if req.method != "POST" || req.query != "delete=" {
+			t.Fatalf("Unexpected request %s ?%s", req.method, req.query)
+		}
+	}
+	if !strings.Contains((*requests)[1].body, "<Key>production/1000</Key>") {
+		t.Fatalf("Expected the last key in the second batch got %s", (*requests)[1].body)
+	}
+}
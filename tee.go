@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Writes to both the cache upload and the client. A failure on one side only
+// stops writes to that side so a client hanging up does not break the cache
+// fill (and a failed upload does not break the client).
+type teeWriter struct {
+	cache     io.Writer
+	client    io.Writer
+	cacheErr  error
+	clientErr error
+}
+
+func (self *teeWriter) Write(p []byte) (int, error) {
+	if self.cacheErr == nil {
+		_, self.cacheErr = self.cache.Write(p)
+	}
+
+	if self.clientErr == nil {
+		_, self.clientErr = self.client.Write(p)
+	}
+
+	// Only give up once there is nobody left to write to.
+	if self.cacheErr != nil && self.clientErr != nil {
+		return 0, self.clientErr
+	}
+	return len(p), nil
+}
+
+// Bytes a tee client may fall behind the cache fill which are kept in memory
+// (anything further behind is spilled to a temporary file).
+var teeClientMemoryLag = 4 * 1024 * 1024
+
+var errClientTooSlow = errors.New("Client fell too far behind the cache fill")
+
+// Writes to the client from its own goroutine so the cache fill goes at the
+// speed of the source rather then the client. Bytes the client has yet to
+// receive are buffered in memory and then in a spill file (so a slow client
+// still gets the whole body once the fill is done). Clients more then maxLag
+// bytes behind are aborted.
+type laggingWriter struct {
+	sync.Mutex
+	ready *sync.Cond
+
+	writer io.Writer
+	// Unblocks a write in progress once the client is aborted.
+	abort     func()
+	memoryLag int
+	maxLag    int64
+
+	queue  [][]byte
+	queued int
+
+	// Once anything is spilled everything after it is too (so the client
+	// gets the bytes in order).
+	spill     *os.File
+	spilled   int64
+	spillRead int64
+
+	closed bool
+	err    error
+	done   chan bool
+}
+
+func newLaggingWriter(writer io.Writer, maxLag int64, abort func()) *laggingWriter {
+	memoryLag := teeClientMemoryLag
+	if int64(memoryLag) > maxLag {
+		memoryLag = int(maxLag)
+	}
+
+	lagging := &laggingWriter{
+		writer:    writer,
+		abort:     abort,
+		memoryLag: memoryLag,
+		maxLag:    maxLag,
+		done:      make(chan bool),
+	}
+	lagging.ready = sync.NewCond(&lagging.Mutex)
+	go lagging.run()
+	return lagging
+}
+
+// Must be called while holding the lock.
+func (self *laggingWriter) lag() int64 {
+	return int64(self.queued) + self.spilled - self.spillRead
+}
+
+func (self *laggingWriter) run() {
+	defer close(self.done)
+	self.Lock()
+	defer self.Unlock()
+
+	buffer := make([]byte, 32*1024)
+	for {
+		for self.lag() == 0 && !self.closed && self.err == nil {
+			self.ready.Wait()
+		}
+		// Done once closed and drained (or the client failed).
+		if self.err != nil || self.lag() == 0 {
+			return
+		}
+
+		if len(self.queue) > 0 {
+			chunk := self.queue[0]
+			self.queue = self.queue[1:]
+
+			self.Unlock()
+			_, err := self.writer.Write(chunk)
+			self.Lock()
+
+			self.queued -= len(chunk)
+			if err != nil && self.err == nil {
+				self.err = err
+			}
+			continue
+		}
+
+		chunk := buffer
+		if remaining := self.spilled - self.spillRead; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		offset := self.spillRead
+
+		self.Unlock()
+		n, err := self.spill.ReadAt(chunk, offset)
+		if err == nil {
+			_, err = self.writer.Write(chunk[:n])
+		}
+		self.Lock()
+
+		self.spillRead += int64(n)
+		if err != nil && self.err == nil {
+			self.err = err
+		}
+	}
+}
+
+// Must be called while holding the lock.
+func (self *laggingWriter) fail(err error) {
+	self.err = err
+	self.queue = nil
+	self.ready.Signal()
+	if self.abort != nil {
+		self.abort()
+	}
+}
+
+func (self *laggingWriter) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if self.err != nil {
+		return 0, self.err
+	}
+
+	if self.lag()+int64(len(p)) > self.maxLag {
+		self.fail(errClientTooSlow)
+		return 0, self.err
+	}
+
+	if self.spill == nil && self.queued+len(p) <= self.memoryLag {
+		// The caller may reuse p (io.Copy does)...
+		chunk := make([]byte, len(p))
+		copy(chunk, p)
+		self.queue = append(self.queue, chunk)
+		self.queued += len(chunk)
+		self.ready.Signal()
+		return len(p), nil
+	}
+
+	if self.spill == nil {
+		spill, err := ioutil.TempFile("", "s3-copy-proxy-tee-")
+		if err != nil {
+			self.fail(err)
+			return 0, err
+		}
+		self.spill = spill
+	}
+
+	n, err := self.spill.WriteAt(p, self.spilled)
+	self.spilled += int64(n)
+	if err != nil {
+		self.fail(err)
+		return n, err
+	}
+	self.ready.Signal()
+	return len(p), nil
+}
+
+// Wait for everything written so far to reach the client.
+func (self *laggingWriter) Close() error {
+	self.Lock()
+	self.closed = true
+	self.ready.Signal()
+	self.Unlock()
+
+	<-self.done
+	if self.spill != nil {
+		self.spill.Close()
+		os.Remove(self.spill.Name())
+	}
+	return self.err
+}
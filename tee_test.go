@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{}
+
+func (self failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("nope")
+}
+
+func TestTeeWriterSurvivesClientFailure(t *testing.T) {
+	cache := &bytes.Buffer{}
+	writer := &teeWriter{cache: cache, client: failingWriter{}}
+
+	for i := 0; i < 2; i++ {
+		_, err := writer.Write([]byte("xfoo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cache.String() != "xfooxfoo" {
+		t.Fatalf("Unexpected cache content %s", cache.String())
+	}
+
+	if writer.clientErr == nil {
+		t.Fatal("Expected client error to be recorded")
+	}
+}
+
+func TestTeeWriterFailsWhenBothSidesFail(t *testing.T) {
+	writer := &teeWriter{cache: failingWriter{}, client: failingWriter{}}
+	_, err := writer.Write([]byte("xfoo"))
+	if err == nil {
+		t.Fatal("Expected an error when both writers fail")
+	}
+}
+
+func TestLaggingWriter(t *testing.T) {
+	client := &bytes.Buffer{}
+	writer := newLaggingWriter(client, 16, nil)
+
+	for i := 0; i < 4; i++ {
+		_, err := writer.Write([]byte("xfoo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.String() != "xfooxfooxfooxfoo" {
+		t.Fatalf("Unexpected client content %s", client.String())
+	}
+}
+
+// Writer which blocks (like a client which stopped reading) until closed.
+type stalledWriter struct {
+	unblock chan bool
+}
+
+func (self *stalledWriter) Write(p []byte) (int, error) {
+	<-self.unblock
+	return 0, io.ErrClosedPipe
+}
+
+func TestLaggingWriterAbortsSlowClient(t *testing.T) {
+	client := &stalledWriter{unblock: make(chan bool)}
+	writer := newLaggingWriter(client, 8, func() { close(client.unblock) })
+
+	// The first write is stuck with the client and the second is buffered...
+	for i := 0; i < 2; i++ {
+		_, err := writer.Write([]byte("xfoo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := writer.Write([]byte("xfoo"))
+	if err != errClientTooSlow {
+		t.Fatalf("Expected the client to be too slow got %v", err)
+	}
+	if writer.Close() != errClientTooSlow {
+		t.Fatal("Expected the client error from close")
+	}
+}
+
+// Response of a client which does not read anything until released (or
+// aborted with a write deadline).
+type stalledResponse struct {
+	*httptest.ResponseRecorder
+	unblock chan bool
+	once    sync.Once
+	aborted bool
+}
+
+func newStalledResponse() *stalledResponse {
+	return &stalledResponse{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan bool)}
+}
+
+func (self *stalledResponse) Release() {
+	self.once.Do(func() { close(self.unblock) })
+}
+
+func (self *stalledResponse) Write(p []byte) (int, error) {
+	<-self.unblock
+	if self.aborted {
+		return 0, io.ErrClosedPipe
+	}
+	return self.ResponseRecorder.Write(p)
+}
+
+// Used by http.ResponseController to cut the client off.
+func (self *stalledResponse) SetWriteDeadline(deadline time.Time) error {
+	self.aborted = true
+	self.Release()
+	return nil
+}
+
+// Serve the slow client in the background and wait until its fill is done.
+func serveSlowClient(t *testing.T, proxy *testProxy, path string) (*stalledResponse, chan bool) {
+	res := newStalledResponse()
+	served := make(chan bool)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		proxy.routes.ServeHTTP(res, req)
+		close(served)
+	}()
+
+	for start := time.Now(); proxy.series()[CACHE_UPLOAD] == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			res.Release()
+			t.Fatal("Expected the fill to finish without the client")
+		}
+	}
+	return res, served
+}
+
+func TestIntegrationTeeSlowClient(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1024*1024)
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		res.Write(body)
+	})
+	defer proxy.Close()
+
+	proxy.config.Tee = true
+	proxy.reset()
+
+	defer func(lag int) { teeClientMemoryLag = lag }(teeClientMemoryLag)
+	teeClientMemoryLag = 64 * 1024
+
+	// A client which is not reading does not hold up the fill...
+	res, served := serveSlowClient(t, proxy, "/slow-client")
+	proxy.expectCached("production/slow-client", string(body))
+
+	hit := proxy.get("/slow-client", nil)
+	proxy.expectRedirect(hit, proxy.bucket.URL("production/slow-client"))
+
+	// ...and still gets the whole body (from the spill) once it catches up.
+	res.Release()
+	<-served
+	if res.Code != 200 || !bytes.Equal(res.Body.Bytes(), body) {
+		t.Fatalf("Expected the slow client to get the whole body got %d with %d bytes", res.Code, res.Body.Len())
+	}
+}
+
+func TestIntegrationTeeSlowClientCutOff(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1024*1024)
+	proxy := newTestProxy(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		res.Write(body)
+	})
+	defer proxy.Close()
+
+	proxy.config.Tee = true
+	proxy.config.TeeMaxClientLag = 128 * 1024
+	proxy.reset()
+
+	defer func(lag int) { teeClientMemoryLag = lag }(teeClientMemoryLag)
+	teeClientMemoryLag = 64 * 1024
+
+	// The fill carries on without the client which fell too far behind...
+	res, served := serveSlowClient(t, proxy, "/slow-client")
+	proxy.expectCached("production/slow-client", string(body))
+
+	// ...which is cut off (without getting anything).
+	<-served
+	if !res.aborted || res.Body.Len() != 0 {
+		t.Fatalf("Expected the slow client to be cut off got %d bytes", res.Body.Len())
+	}
+}
+
+func TestLaggingWriterSpills(t *testing.T) {
+	defer func(lag int) { teeClientMemoryLag = lag }(teeClientMemoryLag)
+	teeClientMemoryLag = 4
+
+	client := newStalledResponse()
+	writer := newLaggingWriter(client, 1024, nil)
+
+	// Everything after the first (stalled) write and a chunk in memory is
+	// spilled...
+	for i := 0; i < 8; i++ {
+		_, err := writer.Write([]byte(fmt.Sprintf("xfoo%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Lock()
+	spilled := writer.spilled
+	writer.Unlock()
+	if spilled == 0 {
+		t.Fatal("Expected the writes to be spilled")
+	}
+
+	client.Release()
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Body.String() != "xfoo0xfoo1xfoo2xfoo3xfoo4xfoo5xfoo6xfoo7" {
+		t.Fatalf("Unexpected client content %s", client.Body.String())
+	}
+	if _, err := os.Stat(writer.spill.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the spill to be removed %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type ttlCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Size bound in memory cache where every entry expires after its own ttl. When
+// full the least recently used entry is dropped. ttlCache is thread safe.
+type ttlCache struct {
+	sync.Mutex
+	maxEntries int
+
+	// Front of the list is the most recently used entry.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newTTLCache(maxEntries int) *ttlCache {
+	return &ttlCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (self *ttlCache) Get(key string) (interface{}, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	element := self.entries[key]
+	if element == nil {
+		return nil, false
+	}
+
+	entry := element.Value.(*ttlCacheEntry)
+	if time.Now().After(entry.expires) {
+		self.lru.Remove(element)
+		delete(self.entries, key)
+		return nil, false
+	}
+
+	self.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+func (self *ttlCache) Set(key string, value interface{}, ttl time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+
+	entry := &ttlCacheEntry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(ttl),
+	}
+
+	if element := self.entries[key]; element != nil {
+		element.Value = entry
+		self.lru.MoveToFront(element)
+		return
+	}
+
+	self.entries[key] = self.lru.PushFront(entry)
+	for self.lru.Len() > self.maxEntries {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*ttlCacheEntry).key)
+	}
+}
+
+func (self *ttlCache) Remove(key string) {
+	self.Lock()
+	defer self.Unlock()
+
+	if element := self.entries[key]; element != nil {
+		self.lru.Remove(element)
+		delete(self.entries, key)
+	}
+}
+
+func (self *ttlCache) Len() int {
+	self.Lock()
+	defer self.Unlock()
+	return self.lru.Len()
+}
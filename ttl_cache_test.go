@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheExpiry(t *testing.T) {
+	cache := newTTLCache(10)
+	cache.Set("xfoo", true, time.Hour)
+	cache.Set("xbar", true, -time.Second)
+
+	if value, ok := cache.Get("xfoo"); !ok || value != true {
+		t.Fatalf("Expected xfoo to be cached got %v", value)
+	}
+
+	if _, ok := cache.Get("xbar"); ok {
+		t.Fatal("Expected xbar to be expired")
+	}
+}
+
+func TestTTLCacheSizeBound(t *testing.T) {
+	cache := newTTLCache(2)
+	cache.Set("a", 1, time.Hour)
+	cache.Set("b", 2, time.Hour)
+	// Touch a so b is the least recently used...
+	cache.Get("a")
+	cache.Set("c", 3, time.Hour)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("Expected b to be dropped")
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("Unexpected number of entries %d", cache.Len())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Source metadata header holding the hex encoded sha256 of the object.
+const SOURCE_SHA256_HEADER = "x-amz-meta-sha256"
+
+// Hashes the content of a cache fill as it streams by so it can be compared
+// with the checksums the source gave us.
+type contentVerifier struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+
+	// Expected checksums (nil when the source did not provide one).
+	expectedMD5    []byte
+	expectedSHA256 []byte
+}
+
+// Find the md5 of the object from the source headers. The ETag is only used
+// when it looks like a plain md5 (multipart and kms encrypted objects in s3
+// have ETags which are not).
+func sourceMD5(header http.Header) []byte {
+	if contentMD5 := header.Get("Content-MD5"); contentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err == nil && len(sum) == md5.Size {
+			return sum
+		}
+	}
+
+	if header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" {
+		return nil
+	}
+
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	sum, err := hex.DecodeString(etag)
+	if err == nil && len(sum) == md5.Size {
+		return sum
+	}
+	return nil
+}
+
+func newContentVerifier(header http.Header, withSHA256 bool) *contentVerifier {
+	verifier := &contentVerifier{
+		md5:         md5.New(),
+		expectedMD5: sourceMD5(header),
+	}
+
+	if withSHA256 {
+		verifier.sha256 = sha256.New()
+		if expected := header.Get(SOURCE_SHA256_HEADER); expected != "" {
+			sum, err := hex.DecodeString(expected)
+			if err == nil && len(sum) == sha256.Size {
+				verifier.expectedSHA256 = sum
+			}
+		}
+	}
+
+	return verifier
+}
+
+func (self *contentVerifier) Write(p []byte) (int, error) {
+	self.md5.Write(p)
+	if self.sha256 != nil {
+		self.sha256.Write(p)
+	}
+	self.size += int64(len(p))
+	return len(p), nil
+}
+
+// Value for the Content-MD5 header of the upload (empty when unknown) so s3
+// rejects the upload itself if the content does not match.
+func (self *contentVerifier) ContentMD5() string {
+	if self.expectedMD5 == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(self.expectedMD5)
+}
+
+// Check everything which went by against the expected length and checksums.
+func (self *contentVerifier) Verify(contentLength int64) error {
+	if self.size != contentLength {
+		return fmt.Errorf("Expected %d bytes but read %d", contentLength, self.size)
+	}
+
+	if sum := self.md5.Sum(nil); self.expectedMD5 != nil && !bytes.Equal(sum, self.expectedMD5) {
+		return fmt.Errorf(
+			"md5 mismatch expected %x got %x", self.expectedMD5, sum,
+		)
+	}
+
+	if self.sha256 == nil {
+		return nil
+	}
+
+	if sum := self.sha256.Sum(nil); self.expectedSHA256 != nil && !bytes.Equal(sum, self.expectedSHA256) {
+		return fmt.Errorf(
+			"sha256 mismatch expected %x got %x", self.expectedSHA256, sum,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// md5 and sha256 of "xfoo"
+const (
+	XFOO_MD5         = "9535a26346adc8a0a04c469191fa9aa1"
+	XFOO_CONTENT_MD5 = "lTWiY0atyKCgTEaRkfqaoQ=="
+	XFOO_SHA256      = "f0abfeda1d6c0d4c95def11795d1f2b3797272623070a4fae413a78164780567"
+)
+
+func TestContentVerifierMatch(t *testing.T) {
+	header := http.Header{}
+	header.Set("ETag", `"`+XFOO_MD5+`"`)
+	header.Set(SOURCE_SHA256_HEADER, XFOO_SHA256)
+
+	verifier := newContentVerifier(header, true)
+	verifier.Write([]byte("xfoo"))
+
+	if verifier.ContentMD5() == "" {
+		t.Fatal("Expected md5 from ETag")
+	}
+
+	err := verifier.Verify(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContentVerifierMismatch(t *testing.T) {
+	header := http.Header{}
+	header.Set("ETag", `"`+XFOO_MD5+`"`)
+	header.Set(SOURCE_SHA256_HEADER, XFOO_SHA256)
+
+	verifier := newContentVerifier(header, true)
+	verifier.Write([]byte("xbar"))
+
+	if verifier.Verify(4) == nil {
+		t.Fatal("Expected checksum mismatch")
+	}
+
+	if verifier.Verify(5) == nil {
+		t.Fatal("Expected length mismatch")
+	}
+}
+
+func TestContentVerifierIgnoresMultipartETag(t *testing.T) {
+	header := http.Header{}
+	header.Set("ETag", `"`+XFOO_MD5+`-2"`)
+
+	verifier := newContentVerifier(header, false)
+	verifier.Write([]byte("xbar"))
+
+	if verifier.ContentMD5() != "" {
+		t.Fatal("Multipart ETags are not an md5")
+	}
+
+	err := verifier.Verify(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+}